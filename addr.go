@@ -0,0 +1,58 @@
+package net_conn_nats_proxy
+
+import (
+	"net"
+	"net/netip"
+)
+
+// natsAddr is a network address as requested by the client, before it is resolved by the proxy.
+type natsAddr struct {
+	network string
+	addr    string
+}
+
+// Network returns the name of the network.
+func (a natsAddr) Network() string {
+	return a.network
+}
+
+// String returns the address as requested by the client.
+func (a natsAddr) String() string {
+	return a.addr
+}
+
+// parseAddr converts an address reported by the proxy into a net.Addr of the given network.
+// It returns nil if the address is empty or cannot be represented.
+func parseAddr(network, addr string) net.Addr {
+	if isUnixNetwork(network) {
+		// the local address of a Unix socket connection is usually unnamed
+		return &net.UnixAddr{Name: addr, Net: network}
+	}
+	if addr == "" {
+		return nil
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			return nil
+		}
+		return net.TCPAddrFromAddrPort(ap)
+	case "udp", "udp4", "udp6":
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			return nil
+		}
+		return net.UDPAddrFromAddrPort(ap)
+	}
+	return nil
+}
+
+// isUnixNetwork reports whether the network is a Unix domain socket network.
+func isUnixNetwork(network string) bool {
+	switch network {
+	case "unix", "unixpacket", "unixgram":
+		return true
+	}
+	return false
+}
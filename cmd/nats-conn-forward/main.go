@@ -0,0 +1,214 @@
+// Command nats-conn-forward exposes targets reachable through a NatsConnProxy as local TCP ports or Unix sockets,
+// like ssh -L, so tools that cannot use NatsNetConn, e.g. redis-cli or psql, can connect to them.
+//
+// Every -L local=remote flag adds a forward. Each connection accepted on the local address
+// opens a NatsNetConn to the remote address on the proxy subject and copies the data both ways:
+//
+//	nats-conn-forward -subject proxy-redis -L 6379=redis.internal:6379 -L unix:/tmp/pg.sock=postgres.internal:5432
+//
+// A bare port listens on the loopback interface. A unix: prefix selects a Unix socket,
+// on the local side as well as on the remote side.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	rnp "github.com/Autodoc-Technology/net-conn-nats-proxy"
+	"github.com/Autodoc-Technology/net-conn-nats-proxy/internal/cmdutil"
+	"github.com/Autodoc-Technology/net-conn-nats-proxy/internal/netutil"
+)
+
+// endpoint is a network address of a forward.
+type endpoint struct {
+	network string
+	addr    string
+}
+
+func (e endpoint) String() string {
+	if e.network == "unix" {
+		return "unix:" + e.addr
+	}
+	return e.addr
+}
+
+// parseEndpoint parses a forward address: host:port, a bare port on the loopback interface or unix:path.
+func parseEndpoint(s string) (endpoint, error) {
+	if path, ok := strings.CutPrefix(s, "unix:"); ok {
+		if path == "" {
+			return endpoint{}, fmt.Errorf("empty unix socket path")
+		}
+		return endpoint{network: "unix", addr: path}, nil
+	}
+	if _, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return endpoint{network: "tcp", addr: net.JoinHostPort("127.0.0.1", s)}, nil
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return endpoint{}, err
+	}
+	return endpoint{network: "tcp", addr: s}, nil
+}
+
+// forward maps a local listening address to a remote address dialed through the proxy.
+type forward struct {
+	local  endpoint
+	remote endpoint
+}
+
+// forwards is a repeatable flag of local=remote mappings.
+type forwards []forward
+
+func (f *forwards) String() string {
+	parts := make([]string, 0, len(*f))
+	for _, fw := range *f {
+		parts = append(parts, fw.local.String()+"="+fw.remote.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *forwards) Set(value string) error {
+	local, remote, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("forward %q: want local=remote", value)
+	}
+	le, err := parseEndpoint(local)
+	if err != nil {
+		return fmt.Errorf("forward %q: local address: %w", value, err)
+	}
+	re, err := parseEndpoint(remote)
+	if err != nil {
+		return fmt.Errorf("forward %q: remote address: %w", value, err)
+	}
+	*f = append(*f, forward{local: le, remote: re})
+	return nil
+}
+
+func main() {
+	var (
+		natsConfig  cmdutil.NATSConfig
+		fws         forwards
+		subject     string
+		dialTimeout time.Duration
+		streaming   bool
+		debug       bool
+	)
+	fs := flag.NewFlagSet("nats-conn-forward", flag.ExitOnError)
+	natsConfig.Register(fs, "nats-conn-forward")
+	fs.Var(&fws, "L", "forward `local=remote`, e.g. 6379=redis.internal:6379 or unix:/tmp/pg.sock=pg.internal:5432; repeatable")
+	fs.StringVar(&subject, "subject", "", "subject of the proxy")
+	fs.DurationVar(&dialTimeout, "dial-timeout", 10*time.Second, "timeout of opening a connection through the proxy")
+	fs.BoolVar(&streaming, "stream", true, "let the proxy push data instead of polling it")
+	fs.BoolVar(&debug, "debug", false, "log every connection")
+	_ = fs.Parse(os.Args[1:])
+
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(log)
+
+	if subject == "" || len(fws) == 0 {
+		fmt.Fprintln(os.Stderr, "nats-conn-forward: -subject and at least one -L are required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	nc, err := natsConfig.Connect()
+	if err != nil {
+		slog.Error("connect to nats", "err", err)
+		os.Exit(1)
+	}
+	defer nc.Close()
+
+	dialer := rnp.NewNatsDialer(nc, subject, rnp.WithStreaming(streaming))
+	listeners := make([]net.Listener, 0, len(fws))
+	for _, fw := range fws {
+		l, err := net.Listen(fw.local.network, fw.local.addr)
+		if err != nil {
+			slog.Error("listen", "local", fw.local, "err", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, l)
+		slog.Info("forward", "local", fw.local, "remote", fw.remote, "subject", subject)
+	}
+
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(ctx, l, fws[i], dialer, dialTimeout)
+		}()
+	}
+	<-ctx.Done()
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	wg.Wait()
+}
+
+// serve accepts the connections on the listener and forwards each of them until the listener is closed.
+// The forwarded connections are closed when the context is done.
+// Accept errors, e.g. running out of file descriptors, are retried with a growing delay like in net/http.
+func serve(ctx context.Context, l net.Listener, fw forward, dialer *rnp.NatsDialer, dialTimeout time.Duration) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var acceptDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			acceptDelay = netutil.AcceptBackoff(acceptDelay)
+			slog.Warn("accept", "local", fw.local, "err", err, "retry", acceptDelay)
+			time.Sleep(acceptDelay)
+			continue
+		}
+		acceptDelay = 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handle(ctx, conn, fw, dialer, dialTimeout)
+		}()
+	}
+}
+
+// handle forwards an accepted connection to the remote address.
+func handle(ctx context.Context, conn net.Conn, fw forward, dialer *rnp.NatsDialer, dialTimeout time.Duration) {
+	log := slog.With("local", fw.local, "remote", fw.remote, "peer", conn.RemoteAddr())
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	remote, err := dialer.DialContext(dialCtx, fw.remote.network, fw.remote.addr)
+	cancel()
+	if err != nil {
+		log.Warn("dial through proxy", "err", err)
+		_ = conn.Close()
+		return
+	}
+	log.Debug("open forwarded connection")
+
+	// close both connections on shutdown, which ends Join
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+		_ = remote.Close()
+	})
+	defer stop()
+	start := time.Now()
+	sent, received := netutil.Join(conn, remote)
+	log.Debug("close forwarded connection", "sent", sent, "received", received, "duration", time.Since(start))
+}
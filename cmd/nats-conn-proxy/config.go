@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	rnp "github.com/Autodoc-Technology/net-conn-nats-proxy"
+	"github.com/Autodoc-Technology/net-conn-nats-proxy/internal/cmdutil"
+)
+
+// config is the configuration of the command, decoded from the JSON configuration file and overridden by the flags.
+type config struct {
+	NATS cmdutil.NATSConfig `json:"nats"`
+	// LogLevel is the lowest level of the logged messages, e.g. "debug" or "info".
+	LogLevel slog.Level `json:"logLevel"`
+	// LogFormat is the format of the log, "text" or "json".
+	LogFormat string `json:"logFormat"`
+	// ShutdownTimeout bounds the time replies in flight are flushed on shutdown.
+	ShutdownTimeout duration `json:"shutdownTimeout"`
+	// Proxies are the proxies to run, one per subject.
+	Proxies []proxyConfig `json:"proxies"`
+}
+
+// proxyConfig is the configuration of a proxy serving one subject. Zero values keep the defaults of the package.
+type proxyConfig struct {
+	Subject         string            `json:"subject"`
+	QueueGroup      string            `json:"queueGroup"`
+	InstanceID      string            `json:"instanceID"`
+	Networks        []string          `json:"networks"`
+	MaxWorkers      int               `json:"maxWorkers"`
+	MaxPending      int               `json:"maxPending"`
+	MaxReadSize     int               `json:"maxReadSize"`
+	MaxWriteSize    int               `json:"maxWriteSize"`
+	MaxHeaderLength int               `json:"maxHeaderLength"`
+	ResolveTimeout  duration          `json:"resolveTimeout"`
+	SessionLease    duration          `json:"sessionLease"`
+	IdleTimeout     duration          `json:"idleTimeout"`
+	Policy          *rnp.AccessPolicy `json:"policy"`
+}
+
+// options returns the proxy options of the configuration.
+func (p proxyConfig) options(log *slog.Logger) []rnp.ProxyOption {
+	options := []rnp.ProxyOption{rnp.WithProxyLogger(log.With("subject", p.Subject))}
+	if p.QueueGroup != "" {
+		options = append(options, rnp.WithQueueGroup(p.QueueGroup))
+	}
+	if p.InstanceID != "" {
+		options = append(options, rnp.WithInstanceID(p.InstanceID))
+	}
+	if len(p.Networks) > 0 {
+		options = append(options, rnp.WithNetworks(p.Networks...))
+	}
+	if p.MaxWorkers > 0 {
+		options = append(options, rnp.WithMaxWorkers(p.MaxWorkers))
+	}
+	if p.MaxPending > 0 {
+		options = append(options, rnp.WithMaxPending(p.MaxPending))
+	}
+	if p.MaxReadSize > 0 {
+		options = append(options, rnp.WithMaxReadSize(p.MaxReadSize))
+	}
+	if p.MaxWriteSize > 0 {
+		options = append(options, rnp.WithMaxWriteSize(p.MaxWriteSize))
+	}
+	if p.MaxHeaderLength > 0 {
+		options = append(options, rnp.WithMaxHeaderLength(p.MaxHeaderLength))
+	}
+	if p.ResolveTimeout > 0 {
+		options = append(options, rnp.WithResolveTimeout(time.Duration(p.ResolveTimeout)))
+	}
+	if p.SessionLease > 0 {
+		options = append(options, rnp.WithSessionLease(time.Duration(p.SessionLease)))
+	}
+	if p.Policy != nil {
+		options = append(options, rnp.WithAccessPolicy(p.Policy))
+	}
+	return options
+}
+
+// duration is a time.Duration decoded from a string such as "30s".
+type duration time.Duration
+
+// UnmarshalText parses the duration.
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// MarshalText formats the duration.
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// defaultShutdownTimeout is the default time replies in flight are flushed on shutdown.
+const defaultShutdownTimeout = 10 * time.Second
+
+// stringList is a flag collecting the values of a repeated flag, each of which may hold several comma separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// flagValues are the values of the command line flags.
+type flagValues struct {
+	configPath      string
+	nats            cmdutil.NATSConfig
+	logLevel        slog.Level
+	logFormat       string
+	shutdownTimeout time.Duration
+	subjects        stringList
+	proxy           proxyConfig
+	resolveTimeout  time.Duration
+	sessionLease    time.Duration
+	idleTimeout     time.Duration
+	networks        stringList
+	allowLoopback   bool
+}
+
+// newFlagSet returns the flag set of the command writing the values into v.
+func newFlagSet(v *flagValues) *flag.FlagSet {
+	fs := flag.NewFlagSet("nats-conn-proxy", flag.ContinueOnError)
+	fs.StringVar(&v.configPath, "config", "", "JSON configuration `file`; flags set on the command line override it")
+	v.nats.Register(fs, "nats-conn-proxy")
+	fs.TextVar(&v.logLevel, "log-level", slog.LevelInfo, "lowest `level` of the logged messages: debug, info, warn or error")
+	fs.StringVar(&v.logFormat, "log-format", "text", "log `format`: text or json")
+	fs.DurationVar(&v.shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "time replies in flight are flushed on shutdown")
+	fs.Var(&v.subjects, "subject", "`subject` to serve; repeatable, adds a proxy unless the configuration file has one for the subject")
+	fs.StringVar(&v.proxy.QueueGroup, "queue-group", "", "queue group shared by the proxy instances (default "+rnp.DefaultQueueGroup+")")
+	fs.Var(&v.networks, "networks", "comma separated `networks` clients may dial (default "+strings.Join(rnp.DefaultNetworks, ",")+")")
+	fs.IntVar(&v.proxy.MaxWorkers, "max-workers", 0, "write requests and other requests executed concurrently, each; reads are not limited")
+	fs.IntVar(&v.proxy.MaxPending, "max-pending", 0, "requests queued while all workers are busy")
+	fs.IntVar(&v.proxy.MaxReadSize, "max-read-size", 0, "largest read request in bytes")
+	fs.IntVar(&v.proxy.MaxWriteSize, "max-write-size", 0, "largest write request in bytes")
+	fs.IntVar(&v.proxy.MaxHeaderLength, "max-header-length", 0, "largest request header value in bytes")
+	fs.DurationVar(&v.resolveTimeout, "resolve-timeout", 0, "time the resolution of a destination may take")
+	fs.DurationVar(&v.sessionLease, "session-lease", 0, "time a session is kept open without activity or keepalive")
+	fs.DurationVar(&v.idleTimeout, "idle-timeout", 0, "time after which an unused upstream connection is closed")
+	fs.BoolVar(&v.allowLoopback, "allow-loopback", false, "allow loopback destinations")
+	return fs
+}
+
+// loadConfig parses the command line arguments and the configuration file they name.
+// The flags set on the command line override the file; proxy flags apply to every proxy.
+func loadConfig(args []string) (*config, error) {
+	var v flagValues
+	fs := newFlagSet(&v)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	cfg := &config{LogLevel: v.logLevel, LogFormat: v.logFormat, ShutdownTimeout: duration(v.shutdownTimeout)}
+	if v.configPath != "" {
+		b, err := os.ReadFile(v.configPath)
+		if err != nil {
+			return nil, fmt.Errorf("read config: %w", err)
+		}
+		if err = json.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("parse config %s: %w", v.configPath, err)
+		}
+	}
+	cfg.NATS.Override(&v.nats, fs)
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["log-level"] {
+		cfg.LogLevel = v.logLevel
+	}
+	if set["log-format"] {
+		cfg.LogFormat = v.logFormat
+	}
+	if set["shutdown-timeout"] {
+		cfg.ShutdownTimeout = duration(v.shutdownTimeout)
+	}
+	for _, subject := range v.subjects {
+		if !cfg.hasSubject(subject) {
+			cfg.Proxies = append(cfg.Proxies, proxyConfig{Subject: subject})
+		}
+	}
+	for i := range cfg.Proxies {
+		v.override(&cfg.Proxies[i], set)
+	}
+	return cfg, cfg.validate()
+}
+
+// override sets the fields of the proxy configuration whose flags were set on the command line.
+func (v *flagValues) override(p *proxyConfig, set map[string]bool) {
+	if set["queue-group"] {
+		p.QueueGroup = v.proxy.QueueGroup
+	}
+	if set["networks"] {
+		p.Networks = v.networks
+	}
+	if set["max-workers"] {
+		p.MaxWorkers = v.proxy.MaxWorkers
+	}
+	if set["max-pending"] {
+		p.MaxPending = v.proxy.MaxPending
+	}
+	if set["max-read-size"] {
+		p.MaxReadSize = v.proxy.MaxReadSize
+	}
+	if set["max-write-size"] {
+		p.MaxWriteSize = v.proxy.MaxWriteSize
+	}
+	if set["max-header-length"] {
+		p.MaxHeaderLength = v.proxy.MaxHeaderLength
+	}
+	if set["resolve-timeout"] {
+		p.ResolveTimeout = duration(v.resolveTimeout)
+	}
+	if set["session-lease"] {
+		p.SessionLease = duration(v.sessionLease)
+	}
+	if set["idle-timeout"] {
+		p.IdleTimeout = duration(v.idleTimeout)
+	}
+	if set["allow-loopback"] {
+		policy := rnp.AccessPolicy{}
+		if p.Policy != nil {
+			policy = *p.Policy
+		}
+		policy.AllowLoopback = v.allowLoopback
+		p.Policy = &policy
+	}
+}
+
+// hasSubject reports whether the configuration has a proxy for the subject.
+func (c *config) hasSubject(subject string) bool {
+	for _, p := range c.Proxies {
+		if p.Subject == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks that the configuration has at least one proxy and that every subject is served once.
+func (c *config) validate() error {
+	if len(c.Proxies) == 0 {
+		return errors.New("no proxy configured, set -subject or the proxies of the configuration file")
+	}
+	seen := make(map[string]bool)
+	for _, p := range c.Proxies {
+		switch {
+		case p.Subject == "":
+			return errors.New("proxy without subject")
+		case seen[p.Subject]:
+			return fmt.Errorf("subject %s is configured twice", p.Subject)
+		}
+		seen[p.Subject] = true
+	}
+	switch c.LogFormat {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q", c.LogFormat)
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = duration(defaultShutdownTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Command nats-conn-proxy runs NatsConnProxy instances that open the connections requested by NATS clients.
+//
+// The proxies are configured by a JSON file and by flags, which override the file:
+//
+//	nats-conn-proxy -config /etc/nats-conn-proxy.json
+//	nats-conn-proxy -server nats://nats:4222 -creds proxy.creds -subject proxy-redis -allow-loopback
+//
+// An example configuration file:
+//
+//	{
+//	  "nats": {"url": "nats://nats:4222", "creds": "/etc/nats/proxy.creds"},
+//	  "logLevel": "info",
+//	  "proxies": [{
+//	    "subject": "proxy-redis",
+//	    "sessionLease": "2m",
+//	    "idleTimeout": "10m",
+//	    "policy": {"allow": [{"hosts": ["*.redis.internal"], "ports": [{"from": 6379, "to": 6379}]}]}
+//	  }]
+//	}
+//
+// SIGHUP reloads the configuration file, see server.reload. SIGINT and SIGTERM shut the proxies down gracefully,
+// a second signal exits right away. The exit status is non-zero if the configuration is invalid or the proxies cannot start.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command and returns its exit status.
+func run(args []string) int {
+	cfg, err := loadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nats-conn-proxy:", err)
+		return 2
+	}
+	level := new(slog.LevelVar)
+	level.Set(cfg.LogLevel)
+	log := newLogger(cfg.LogFormat, level)
+	slog.SetDefault(log)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	s, err := start(cfg, log)
+	if err != nil {
+		log.Error("start", "err", err)
+		return 1
+	}
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Info("shutting down", "signal", sig.String())
+			break
+		}
+		reloaded, err := loadConfig(args)
+		if err == nil {
+			s, err = reloadServer(s, reloaded, level)
+		}
+		if err != nil {
+			log.Error("reload configuration, keeping the running one", "err", err)
+			continue
+		}
+		log.Info("configuration reloaded")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case sig := <-signals:
+		log.Warn("exiting without graceful shutdown", "signal", sig.String())
+		return 1
+	}
+}
+
+// reloadServer applies the configuration to the server and the log level, and returns the server running it.
+// If the configuration cannot be applied, the server is returned unchanged with the error. The log format is fixed at start.
+func reloadServer(s *server, cfg *config, level *slog.LevelVar) (*server, error) {
+	next, err := s.reload(cfg)
+	if err != nil {
+		return s, err
+	}
+	level.Set(cfg.LogLevel)
+	return next, nil
+}
+
+// newLogger returns the logger writing to stderr in the format.
+func newLogger(format string, level *slog.LevelVar) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"time"
+
+	rnp "github.com/Autodoc-Technology/net-conn-nats-proxy"
+	"github.com/nats-io/nats.go"
+)
+
+// runningProxy is a started proxy and the resources it owns.
+type runningProxy struct {
+	cfg  proxyConfig
+	pool *rnp.NetConnPullManager
+	stop context.CancelFunc
+}
+
+// close stops the proxy, which ends its sessions, and closes its upstream connections.
+func (p *runningProxy) close() {
+	p.stop()
+	_ = p.pool.Close()
+}
+
+// server runs the proxies of the configuration on a NATS connection.
+type server struct {
+	cfg     *config
+	log     *slog.Logger
+	nc      *nats.Conn
+	proxies map[string]*runningProxy
+}
+
+// start connects to NATS and starts the proxies of the configuration.
+// It fails if any proxy cannot subscribe, stopping the proxies it started.
+func start(cfg *config, log *slog.Logger) (*server, error) {
+	nc, err := cfg.NATS.Connect()
+	if err != nil {
+		return nil, err
+	}
+	s := &server{cfg: cfg, log: log, nc: nc, proxies: make(map[string]*runningProxy)}
+	for _, p := range cfg.Proxies {
+		rp, err := s.startProxy(p)
+		if err != nil {
+			s.closeProxies()
+			nc.Close()
+			return nil, err
+		}
+		s.proxies[p.Subject] = rp
+	}
+	return s, nil
+}
+
+// startProxy starts a proxy serving the subject of the configuration.
+func (s *server) startProxy(p proxyConfig) (*runningProxy, error) {
+	pool := rnp.NewNetConnPullManager(rnp.DefaultDial, rnp.WithIdleTimeout(time.Duration(p.IdleTimeout)), rnp.WithPoolLogger(s.log))
+	proxy := rnp.NewNatsConnProxy(s.nc, p.Subject, pool, p.options(s.log)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := proxy.Start(ctx); err != nil {
+		cancel()
+		_ = pool.Close()
+		return nil, fmt.Errorf("start proxy on %s: %w", p.Subject, err)
+	}
+	s.log.Info("proxy started", "subject", p.Subject)
+	return &runningProxy{cfg: p, pool: pool, stop: cancel}, nil
+}
+
+// reload applies a new configuration. If the NATS settings changed, a new server is started on a new connection
+// and replaces the running one. Otherwise, only the proxies whose configuration changed are restarted,
+// which ends their sessions, and the sessions of the other proxies are kept.
+// If the new configuration cannot be applied, the running proxies keep serving the old one,
+// except for the proxies with a fixed instance ID, which are stopped before their replacement starts.
+func (s *server) reload(cfg *config) (*server, error) {
+	if !reflect.DeepEqual(cfg.NATS, s.cfg.NATS) {
+		next, err := start(cfg, s.log)
+		if err != nil {
+			return nil, err
+		}
+		s.log.Info("nats settings changed, sessions of the old connection are closed")
+		s.shutdown()
+		return next, nil
+	}
+
+	started := make(map[string]*runningProxy)
+	for _, p := range cfg.Proxies {
+		rp, ok := s.proxies[p.Subject]
+		if ok && reflect.DeepEqual(rp.cfg, p) {
+			continue
+		}
+		if ok && p.InstanceID != "" && p.InstanceID == rp.cfg.InstanceID {
+			// two instances with the same ID would both serve the sessions, the old one must go first
+			rp.close()
+			delete(s.proxies, p.Subject)
+		}
+		rp, err := s.startProxy(p)
+		if err != nil {
+			for _, rp := range started {
+				rp.close()
+			}
+			return nil, err
+		}
+		started[p.Subject] = rp
+	}
+	for subject, rp := range s.proxies {
+		if _, restarted := started[subject]; restarted || !cfg.hasSubject(subject) {
+			rp.close()
+			delete(s.proxies, subject)
+			s.log.Info("proxy stopped", "subject", subject)
+		}
+	}
+	for subject, rp := range started {
+		s.proxies[subject] = rp
+	}
+	s.cfg = cfg
+	return s, nil
+}
+
+// shutdown stops the proxies and drains the NATS connection, so the replies in flight are delivered,
+// waiting at most the shutdown timeout.
+func (s *server) shutdown() {
+	for _, rp := range s.proxies {
+		rp.stop()
+	}
+	closed := make(chan struct{})
+	s.nc.SetClosedHandler(func(*nats.Conn) { close(closed) })
+	if err := s.nc.Drain(); err != nil {
+		s.nc.Close()
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Duration(s.cfg.ShutdownTimeout)):
+		s.log.Warn("drain nats connection timed out")
+		s.nc.Close()
+	}
+	s.closeProxies()
+}
+
+// closeProxies stops the proxies and closes their upstream connections.
+func (s *server) closeProxies() {
+	for subject, rp := range s.proxies {
+		rp.close()
+		delete(s.proxies, subject)
+	}
+}
@@ -0,0 +1,150 @@
+// Command nats-conn-socks runs a SOCKS5 server that opens the requested connections through a NatsConnProxy,
+// so any SOCKS-capable client, e.g. a browser or curl --socks5-hostname, can reach the targets of the proxy:
+//
+//	nats-conn-socks -subject proxy-internal -listen 127.0.0.1:1080
+//
+// Domain names are resolved by the proxy. Clients authenticate with a username and password
+// if -socks-user and -socks-password or an -auth-file of user:password lines are given.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	rnp "github.com/Autodoc-Technology/net-conn-nats-proxy"
+	"github.com/Autodoc-Technology/net-conn-nats-proxy/internal/cmdutil"
+	"github.com/Autodoc-Technology/net-conn-nats-proxy/socks5"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command and returns its exit status.
+func run(args []string) int {
+	var (
+		natsConfig  cmdutil.NATSConfig
+		listen      string
+		subject     string
+		user        string
+		password    string
+		authFile    string
+		dialTimeout time.Duration
+		streaming   bool
+		debug       bool
+	)
+	fs := flag.NewFlagSet("nats-conn-socks", flag.ContinueOnError)
+	natsConfig.Register(fs, "nats-conn-socks")
+	fs.StringVar(&listen, "listen", "127.0.0.1:1080", "address of the SOCKS5 server")
+	fs.StringVar(&subject, "subject", "", "subject of the proxy")
+	fs.StringVar(&user, "socks-user", "", "username SOCKS clients authenticate with")
+	fs.StringVar(&password, "socks-password", os.Getenv("SOCKS_PASSWORD"), "password SOCKS clients authenticate with ($SOCKS_PASSWORD)")
+	fs.StringVar(&authFile, "auth-file", "", "file of user:password lines SOCKS clients authenticate with")
+	fs.DurationVar(&dialTimeout, "dial-timeout", socks5.DefaultDialTimeout, "timeout of opening a connection through the proxy")
+	fs.BoolVar(&streaming, "stream", true, "let the proxy push data instead of polling it")
+	fs.BoolVar(&debug, "debug", false, "log every failed connection")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if subject == "" {
+		fmt.Fprintln(os.Stderr, "nats-conn-socks: -subject is required")
+		fs.Usage()
+		return 2
+	}
+
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	credentials, err := loadCredentials(user, password, authFile)
+	if err != nil {
+		slog.Error("load credentials", "err", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	nc, err := natsConfig.Connect()
+	if err != nil {
+		slog.Error("connect to nats", "err", err)
+		return 1
+	}
+	defer nc.Close()
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		slog.Error("listen", "addr", listen, "err", err)
+		return 1
+	}
+	context.AfterFunc(ctx, func() { _ = l.Close() })
+
+	dialer := rnp.NewNatsDialer(nc, subject, rnp.WithStreaming(streaming))
+	options := []socks5.ServerOption{socks5.WithDialTimeout(dialTimeout)}
+	if len(credentials) > 0 {
+		options = append(options, socks5.WithAuth(credentials.valid))
+	}
+	server := socks5.NewServer(dialer.DialContext, options...)
+	slog.Info("socks5 server", "addr", l.Addr(), "subject", subject, "auth", len(credentials) > 0)
+	if err := server.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Error("serve", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// credentials maps the usernames to the passwords of the SOCKS clients.
+type credentials map[string]string
+
+// valid reports whether the password belongs to the user.
+func (c credentials) valid(user, password string) bool {
+	want, ok := c[user]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
+
+// loadCredentials returns the credentials given by the flags and the lines of the auth file, if any.
+func loadCredentials(user, password, authFile string) (credentials, error) {
+	c := credentials{}
+	if user != "" {
+		c[user] = password
+	} else if password != "" && authFile == "" {
+		return nil, errors.New("-socks-password requires -socks-user")
+	}
+	if authFile == "" {
+		return c, nil
+	}
+	f, err := os.Open(authFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		u, p, ok := strings.Cut(text, ":")
+		if !ok || u == "" {
+			return nil, fmt.Errorf("%s:%d: want user:password", authFile, line)
+		}
+		c[u] = p
+	}
+	return c, scanner.Err()
+}
@@ -0,0 +1,114 @@
+// Command nats-conn-stdio connects its standard input and output to a target reachable through a NatsConnProxy,
+// like nc or ssh -W. It is meant to be used as an ssh ProxyCommand:
+//
+//	ssh -o 'ProxyCommand nats-conn-stdio -subject proxy-ssh %h:%p' host.internal
+//
+// The end of the standard input closes the write side of the connection, so the target reads EOF
+// and can still send its reply. The command exits once the target closes the connection.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	rnp "github.com/Autodoc-Technology/net-conn-nats-proxy"
+	"github.com/Autodoc-Technology/net-conn-nats-proxy/internal/cmdutil"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command and returns its exit status.
+func run(args []string) int {
+	var (
+		natsConfig  cmdutil.NATSConfig
+		subject     string
+		network     string
+		dialTimeout time.Duration
+		streaming   bool
+		debug       bool
+	)
+	fs := flag.NewFlagSet("nats-conn-stdio", flag.ContinueOnError)
+	natsConfig.Register(fs, "nats-conn-stdio")
+	fs.StringVar(&subject, "subject", "", "subject of the proxy")
+	fs.StringVar(&network, "network", "tcp", "network of the target")
+	fs.DurationVar(&dialTimeout, "dial-timeout", 10*time.Second, "timeout of opening the connection through the proxy")
+	fs.BoolVar(&streaming, "stream", true, "let the proxy push data instead of polling it")
+	fs.BoolVar(&debug, "debug", false, "log the connection")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: nats-conn-stdio -subject subject [flags] host:port")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if subject == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	target := fs.Arg(0)
+
+	// the standard output carries the data, the log goes to the standard error
+	level := slog.LevelWarn
+	if debug {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+
+	nc, err := natsConfig.Connect()
+	if err != nil {
+		slog.Error("connect to nats", "err", err)
+		return 1
+	}
+	defer nc.Close()
+
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	conn, err := rnp.DialNatsNetConn(dialCtx, nc, subject, network, target, rnp.WithStreaming(streaming))
+	cancel()
+	if err != nil {
+		slog.Error("dial through proxy", "target", target, "err", err)
+		return 1
+	}
+	defer conn.Close()
+	slog.Debug("connected", "target", target, "subject", subject)
+
+	// a signal closes the connection, which ends the copy from it
+	closeOnSignal := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer closeOnSignal()
+
+	go func() {
+		n, err := io.Copy(conn, os.Stdin)
+		slog.Debug("standard input ended", "sent", n, "err", err)
+		if err != nil {
+			// the connection failed, which ends the copy to the standard output too
+			_ = conn.Close()
+			return
+		}
+		if err = conn.CloseWrite(); err != nil {
+			slog.Warn("close write side", "err", err)
+		}
+	}()
+
+	n, err := io.Copy(os.Stdout, conn)
+	slog.Debug("connection ended", "received", n, "err", err)
+	if err != nil && ctx.Err() == nil {
+		slog.Error("copy to standard output", "err", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,181 @@
+package net_conn_nats_proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// readTimeoutHeaderKey carries the time left until the read deadline of the client, e.g. "1.5s".
+	readTimeoutHeaderKey = "read-timeout"
+	// writeTimeoutHeaderKey carries the time left until the write deadline of the client.
+	writeTimeoutHeaderKey = "write-timeout"
+)
+
+// DefaultDeadlineMargin is the default extra time a client waits for the reply of a request bounded by a deadline,
+// so the timeout error of the proxy arrives before the request itself times out.
+const DefaultDeadlineMargin = 500 * time.Millisecond
+
+// readPollTimeout is the longest time a read request waits on the proxy.
+// Reads without a deadline, or with a farther one, are long polls that send a new request after each poll timeout.
+const readPollTimeout = 10 * time.Second
+
+// connDeadline is a read or write deadline of a connection.
+// Operations waiting for it are woken up when the deadline changes, as a new deadline may have passed already.
+type connDeadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+// set changes the deadline and wakes up the waiting operations.
+func (d *connDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+	}
+	d.changed = make(chan struct{})
+}
+
+// get returns the deadline and a channel that is closed when it changes.
+func (d *connDeadline) get() (time.Time, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	return d.t, d.changed
+}
+
+// wait blocks until the signal is closed or the deadline changes, and returns os.ErrDeadlineExceeded if the deadline passes first.
+// A zero deadline waits without a time limit.
+func (d *connDeadline) wait(signal <-chan struct{}) error {
+	deadline, changed := d.get()
+	if deadline.IsZero() {
+		select {
+		case <-signal:
+		case <-changed:
+		}
+		return nil
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-signal:
+	case <-changed:
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// errDeadlineChanged is returned by requestUntil if the deadline changed while the request was waiting for the reply.
+var errDeadlineChanged = errors.New("deadline changed")
+
+// requestUntil sends the request and waits for the reply until the wait time passes, the changed channel is closed
+// or the connection is closed, which returns errDeadlineChanged or net.ErrClosed respectively.
+func (c *NatsNetConn) requestUntil(req *nats.Msg, wait time.Duration, changed <-chan struct{}) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	var reason error
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-changed:
+			reason = errDeadlineChanged
+		case <-c.done:
+			reason = net.ErrClosed
+		case <-stop:
+			return
+		}
+		cancel()
+	}()
+
+	msg, err := c.nc.RequestMsgWithContext(ctx, req)
+	if errors.Is(err, context.Canceled) {
+		// the context is only canceled by the goroutine after it set the reason
+		return nil, reason
+	}
+	return msg, err
+}
+
+// requestRead sends the read requests built by newReq until one of them is answered.
+// The read waits without a time limit if there is no read deadline: it long-polls the proxy with requests bounded by readPollTimeout.
+// Setting a new deadline or closing the connection interrupts the wait right away;
+// the data the proxy reads in the meantime is delivered by a later read, see readOffsetHeaderKey.
+func (c *NatsNetConn) requestRead(newReq func(timeout time.Time) *nats.Msg) (*nats.Msg, error) {
+	for {
+		deadline, changed := c.readDeadLine.get()
+		if deadlinePassed(deadline) {
+			return nil, c.wrapError("read", os.ErrDeadlineExceeded)
+		}
+		poll := time.Now().Add(readPollTimeout)
+		polling := deadline.IsZero() || deadline.After(poll)
+		if !polling {
+			poll = deadline
+		}
+
+		msg, err := c.requestUntil(newReq(poll), c.replyTimeout(poll), changed)
+		switch {
+		case errors.Is(err, errDeadlineChanged):
+			continue
+		case err != nil:
+			err = c.requestError("read", err)
+		default:
+			err = c.replyError("read", msg)
+		}
+		if polling && errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
+
+// setTimeoutHeader sets the header to the time left until the deadline.
+// Deadlines travel as relative timeouts, so the proxy does not depend on the clock of the client.
+// A zero deadline sets no header, which clears the deadline on the proxy.
+func setTimeoutHeader(h nats.Header, key string, deadline time.Time) {
+	if deadline.IsZero() {
+		return
+	}
+	h.Set(key, max(time.Until(deadline), time.Nanosecond).String())
+}
+
+// parseTimeoutHeader returns the deadline on the clock of the proxy for the relative timeout in the header,
+// or the zero time if the header is absent, i.e. the client has no deadline.
+// The header was validated before the request was dispatched.
+func parseTimeoutHeader(h nats.Header, key string) time.Time {
+	timeout, err := time.ParseDuration(h.Get(key))
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// replyTimeout returns how long the client waits for the reply of a request bounded by the deadline:
+// the time left until the deadline plus the margin, or the request timeout if there is no deadline.
+func (c *NatsNetConn) replyTimeout(deadline time.Time) time.Duration {
+	if deadline.IsZero() {
+		return c.opts.requestTimeout
+	}
+	return time.Until(deadline) + c.opts.deadlineMargin
+}
+
+// deadlinePassed reports whether the deadline is set and has passed.
+func deadlinePassed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
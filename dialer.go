@@ -0,0 +1,69 @@
+package net_conn_nats_proxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NatsDialer opens NatsNetConn and NatsPacketConn connections through the proxy listening on the subject.
+// Its methods have the signatures of the usual dial hooks, so the dialer can be plugged in directly:
+//
+//	redis.Options{Dialer: dialer.DialContext}
+//	http.Transport{DialContext: dialer.DialContext}
+//	grpc.WithContextDialer(dialer.DialAddrContext)
+type NatsDialer struct {
+	// Conn is the NATS connection used to reach the proxy.
+	Conn *nats.Conn
+	// Subject is the subject the proxy listens on.
+	Subject string
+	// Options are applied to every connection opened by the dialer.
+	Options []ConnOption
+}
+
+// NewNatsDialer returns a new NatsDialer for the proxy listening on the subject.
+func NewNatsDialer(nc *nats.Conn, subject string, options ...ConnOption) *NatsDialer {
+	return &NatsDialer{Conn: nc, Subject: subject, Options: options}
+}
+
+// Dial connects to the address on the named network through the proxy.
+// It is equivalent to DialContext with context.Background().
+func (d *NatsDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address on the named network through the proxy.
+// Host names in the address are resolved by the proxy.
+// On UDP networks the connection is a connected NatsPacketConn, which keeps the datagram boundaries.
+// The context governs the open handshake; once the connection is established, the context has no effect on it.
+func (d *NatsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if isDatagramNetwork(network) {
+		conn, err := DialNatsPacketConn(ctx, d.Conn, d.Subject, network, addr, d.Options...)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	conn, err := DialNatsNetConn(ctx, d.Conn, d.Subject, network, addr, d.Options...)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenPacket opens an unconnected datagram connection on the named network, e.g. "udp", through the proxy.
+// It matches the signature of net.ListenConfig.ListenPacket; the address is ignored, as the proxy listens on an ephemeral port.
+func (d *NatsDialer) ListenPacket(ctx context.Context, network, _ string) (net.PacketConn, error) {
+	conn, err := ListenNatsPacket(ctx, d.Conn, d.Subject, network, d.Options...)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialAddrContext connects to the TCP address through the proxy.
+// It matches the dialer signature of grpc.WithContextDialer.
+func (d *NatsDialer) DialAddrContext(ctx context.Context, addr string) (net.Conn, error) {
+	return d.DialContext(ctx, "tcp", addr)
+}
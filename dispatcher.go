@@ -0,0 +1,103 @@
+package net_conn_nats_proxy
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrProxyBusy is reported when the proxy has no room left to queue a request.
+var ErrProxyBusy = errors.New("proxy busy: too many pending requests")
+
+// errDispatcherClosed is returned by dispatcher.submit after the dispatcher has been stopped.
+var errDispatcherClosed = errors.New("dispatcher closed")
+
+// dispatcher runs submitted tasks concurrently on a bounded number of workers.
+// Tasks that share a lane key are executed one at a time in submission order,
+// while tasks from different lanes run in parallel.
+// A blocking task therefore only delays the tasks queued behind it in the same lane.
+type dispatcher struct {
+	mu         sync.Mutex
+	lanes      map[string]*lane
+	workers    chan struct{}
+	pending    int
+	maxPending int
+	closed     bool
+}
+
+// lane holds the ordered queue of tasks waiting for a single lane key.
+type lane struct {
+	queue []func()
+}
+
+// newDispatcher creates a dispatcher that runs at most maxWorkers tasks at once
+// and queues at most maxPending tasks that are waiting for a worker.
+// A negative maxWorkers runs every lane right away: the concurrency is bounded by the number of lanes only.
+func newDispatcher(maxWorkers, maxPending int) *dispatcher {
+	if maxWorkers < 0 {
+		return &dispatcher{lanes: make(map[string]*lane), maxPending: maxPending}
+	}
+	if maxWorkers == 0 {
+		maxWorkers = 1
+	}
+	return &dispatcher{
+		lanes:      make(map[string]*lane),
+		workers:    make(chan struct{}, maxWorkers),
+		maxPending: maxPending,
+	}
+}
+
+// submit queues the task on the lane identified by key.
+// It never blocks: if the pending limit is reached it returns ErrProxyBusy.
+func (d *dispatcher) submit(key string, task func()) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return errDispatcherClosed
+	}
+	if d.maxPending > 0 && d.pending >= d.maxPending {
+		return ErrProxyBusy
+	}
+	d.pending++
+
+	l, ok := d.lanes[key]
+	if ok {
+		l.queue = append(l.queue, task)
+		return nil
+	}
+	l = &lane{queue: []func(){task}}
+	d.lanes[key] = l
+	go d.run(key, l)
+	return nil
+}
+
+// run drains the lane queue on a single worker slot and removes the lane once it is empty.
+func (d *dispatcher) run(key string, l *lane) {
+	if d.workers != nil {
+		d.workers <- struct{}{}
+		defer func() { <-d.workers }()
+	}
+
+	for {
+		d.mu.Lock()
+		if len(l.queue) == 0 {
+			delete(d.lanes, key)
+			d.mu.Unlock()
+			return
+		}
+		task := l.queue[0]
+		l.queue[0] = nil
+		l.queue = l.queue[1:]
+		d.pending--
+		d.mu.Unlock()
+
+		task()
+	}
+}
+
+// close stops accepting new tasks. Tasks that are already queued still run to completion.
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+}
@@ -0,0 +1,191 @@
+package net_conn_nats_proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrorCode is a machine-readable reason sent by the proxy together with an error reply.
+// The client uses it to rebuild an error that behaves like the one returned by a local socket.
+type ErrorCode string
+
+const (
+	// ErrCodeTimeout reports that an upstream deadline was exceeded.
+	ErrCodeTimeout ErrorCode = "timeout"
+	// ErrCodeEOF reports that the upstream peer closed its side of the connection.
+	ErrCodeEOF ErrorCode = "eof"
+	// ErrCodeRefused reports that the upstream connection could not be established.
+	ErrCodeRefused ErrorCode = "refused"
+	// ErrCodeUnreachable reports that the upstream host could not be resolved or reached.
+	ErrCodeUnreachable ErrorCode = "unreachable"
+	// ErrCodeClosed reports that the upstream connection is already closed.
+	ErrCodeClosed ErrorCode = "closed"
+	// ErrCodeDenied reports that the proxy does not allow the requested operation or destination.
+	ErrCodeDenied ErrorCode = "denied"
+	// ErrCodeBusy reports that the proxy has no capacity left to handle the request.
+	ErrCodeBusy ErrorCode = "busy"
+	// ErrCodeInvalid reports that the proxy rejected a malformed request or one exceeding its limits.
+	ErrCodeInvalid ErrorCode = "invalid"
+	// ErrCodeUnknown reports any other error.
+	ErrCodeUnknown ErrorCode = "error"
+)
+
+// errCodeHeaderKey is the header carrying the ErrorCode of an error reply.
+const errCodeHeaderKey = "err-code"
+
+// _ is a variable of type net.Error
+// It is used to assert that the type ProxyError implements the net.Error interface.
+var _ net.Error = &ProxyError{}
+
+// ProxyError is an error reported by the proxy for an operation on the upstream connection.
+// It matches the standard library errors of the same meaning with errors.Is,
+// e.g. a ProxyError with ErrCodeTimeout matches os.ErrDeadlineExceeded.
+type ProxyError struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Error returns the message reported by the proxy.
+func (e *ProxyError) Error() string {
+	if e.Message == "" {
+		return "proxy error: " + string(e.Code)
+	}
+	return "proxy error: " + e.Message
+}
+
+// Timeout reports whether the error is caused by an exceeded deadline.
+func (e *ProxyError) Timeout() bool {
+	return e.Code == ErrCodeTimeout
+}
+
+// Temporary reports whether retrying the operation may succeed.
+func (e *ProxyError) Temporary() bool {
+	return e.Code == ErrCodeTimeout || e.Code == ErrCodeBusy
+}
+
+// Is matches the ProxyError against the standard library error of the same meaning.
+func (e *ProxyError) Is(target error) bool {
+	switch e.Code {
+	case ErrCodeTimeout:
+		return target == os.ErrDeadlineExceeded
+	case ErrCodeEOF:
+		return target == io.EOF
+	case ErrCodeClosed:
+		return target == net.ErrClosed
+	case ErrCodeRefused:
+		return target == syscall.ECONNREFUSED
+	case ErrCodeUnreachable:
+		return target == syscall.EHOSTUNREACH
+	case ErrCodeBusy:
+		return target == ErrProxyBusy
+	case ErrCodeDenied:
+		return target == ErrAccessDenied
+	case ErrCodeInvalid:
+		return target == ErrInvalidRequest
+	}
+	return false
+}
+
+// errorCodeOf classifies the error returned by an upstream operation.
+func errorCodeOf(err error) ErrorCode {
+	var pe *ProxyError
+	var ne net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &pe):
+		return pe.Code
+	case errors.Is(err, io.EOF):
+		return ErrCodeEOF
+	case errors.Is(err, ErrProxyBusy):
+		return ErrCodeBusy
+	case errors.Is(err, ErrAccessDenied):
+		return ErrCodeDenied
+	case errors.Is(err, ErrInvalidRequest):
+		return ErrCodeInvalid
+	case errors.Is(err, net.ErrClosed):
+		return ErrCodeClosed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrCodeRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH), errors.As(err, &dnsErr) && !dnsErr.IsTimeout:
+		return ErrCodeUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return ErrCodeTimeout
+	}
+	return ErrCodeUnknown
+}
+
+// newErrorMsg creates a reply message that carries the error and its code in the headers.
+func newErrorMsg(err error) *nats.Msg {
+	reply := nats.NewMsg("")
+	reply.Header.Set(errHeaderKey, err.Error())
+	reply.Header.Set(errCodeHeaderKey, string(errorCodeOf(err)))
+	return reply
+}
+
+// respondError replies to the request with an empty payload and the error in the message headers.
+func respondError(msg *nats.Msg, err error) {
+	_ = msg.RespondMsg(newErrorMsg(err))
+}
+
+// replyError extracts the error carried by a proxy reply, or returns nil if the reply reports success.
+// EOF is returned as the bare io.EOF, as expected by io.Reader users.
+// Other errors are wrapped into a *net.OpError describing the operation.
+func (c *NatsNetConn) replyError(op string, msg *nats.Msg) error {
+	return c.wrapError(op, remoteError(msg))
+}
+
+// remoteError rebuilds the error carried by a proxy reply, or returns nil if the reply reports success.
+// Deadline and closed-connection errors are returned as os.ErrDeadlineExceeded and net.ErrClosed.
+func remoteError(msg *nats.Msg) error {
+	msgErr := msg.Header.Get(errHeaderKey)
+	if msgErr == "" {
+		return nil
+	}
+	code := ErrorCode(msg.Header.Get(errCodeHeaderKey))
+	switch code {
+	case ErrCodeEOF:
+		return io.EOF
+	case ErrCodeTimeout:
+		return os.ErrDeadlineExceeded
+	case ErrCodeClosed:
+		return net.ErrClosed
+	case "":
+		code = ErrCodeUnknown
+	}
+	return &ProxyError{Code: code, Message: msgErr}
+}
+
+// wrapError wraps the error into a *net.OpError unless it is nil or io.EOF.
+func (c *NatsNetConn) wrapError(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return c.opError(op, err)
+}
+
+// requestError converts an error of a NATS request into a net.Error.
+func (c *NatsNetConn) requestError(op string, err error) error {
+	switch {
+	case errors.Is(err, nats.ErrTimeout), errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return c.opError(op, os.ErrDeadlineExceeded)
+	case errors.Is(err, nats.ErrNoResponders) && op == "dial":
+		return c.opError(op, &ProxyError{Code: ErrCodeRefused, Message: "no proxy is listening on " + c.subject})
+	case errors.Is(err, nats.ErrNoResponders):
+		// the proxy instance holding the session is gone, and the session with it
+		return c.opError(op, &ProxyError{Code: ErrCodeClosed, Message: "proxy session is gone"})
+	case errors.Is(err, nats.ErrConnectionClosed):
+		return c.opError(op, net.ErrClosed)
+	}
+	return c.opError(op, err)
+}
+
+// opError wraps the error into a *net.OpError describing the operation on the connection.
+func (c *NatsNetConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: c.addr.Network(), Source: c.LocalAddr(), Addr: c.addr, Err: err}
+}
@@ -8,7 +8,6 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/redis/go-redis/v9"
 	"log/slog"
-	"net"
 	"os"
 	"os/signal"
 	"sync"
@@ -50,21 +49,15 @@ func main() {
 		// To prevent Redis Cluster errors, disable the following options
 		//RouteRandomly:  false,
 		//RouteByLatency: false,
-		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			tcpAddr, err := net.ResolveTCPAddr(network, addr)
-			if err != nil {
-				return nil, err
-			}
-			slog.Debug("new connection", "addr", tcpAddr.String())
-			var netConn net.Conn
-			netConn, err = rnp.NewNatsNetConn(nc, "proxy-redis", tcpAddr)
-			if err != nil {
-				return nil, err
-			}
-			// to log the connection, use the following line
-			//netConn = rnp.NewDebugLogNetConn(netConn)
-			return netConn, nil
-		},
+		Dialer: rnp.NewNatsDialer(nc, "proxy-redis").DialContext,
+		// to log the connections, wrap the dialer with rnp.NewDebugLogNetConn:
+		//Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		//	conn, err := rnp.NewNatsDialer(nc, "proxy-redis").DialContext(ctx, network, addr)
+		//	if err != nil {
+		//		return nil, err
+		//	}
+		//	return rnp.NewDebugLogNetConn(conn), nil
+		//},
 	}
 	rc := redis.NewUniversalClient(redisOptions)
 	defer func(rc redis.UniversalClient) {
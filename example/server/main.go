@@ -35,8 +35,10 @@ func main() {
 	pm := rnp.NewNetConnPullManager(dialFunc)
 	// To create a pool with the default Dial function use the following argument rnp.DefaultDial
 	//pm := rnp.NewNetConnPullManager(rnp.DefaultDial)
-	// Create a proxy with the custom pull manager
-	proxy := rnp.NewNatsConnProxy(nc, "proxy-redis", pm)
+	// Create a proxy with the custom pull manager.
+	// The example Redis server runs on localhost, which the default access policy denies.
+	policy := &rnp.AccessPolicy{AllowLoopback: true}
+	proxy := rnp.NewNatsConnProxy(nc, "proxy-redis", pm, rnp.WithAccessPolicy(policy))
 	go func() {
 		if err := proxy.Start(ctx); err != nil {
 			slog.Error("start proxy", "err", err)
@@ -0,0 +1,40 @@
+package net_conn_nats_proxy
+
+import "github.com/nats-io/nats.go"
+
+const (
+	// frameHeaderReserve is the part of the NATS max payload reserved for the headers of a frame.
+	frameHeaderReserve = 4 * 1024
+	// minFrameSize is the frame size used when the max payload of the server is unknown or too small to reserve the headers.
+	minFrameSize = 4 * 1024
+)
+
+// maxFrameSize returns the largest number of data bytes that fit into a single message on the NATS connection,
+// i.e. the max payload announced by the server minus the room reserved for the headers.
+// Reads and writes larger than a frame are split into several messages.
+func maxFrameSize(nc *nats.Conn) int {
+	if payload := int(nc.MaxPayload()); payload-frameHeaderReserve > minFrameSize {
+		return payload - frameHeaderReserve
+	}
+	return minFrameSize
+}
+
+// readFrameSize returns the largest number of bytes the connection requests with a single read,
+// bounded by the max payload and by the read limit announced by the proxy.
+func (c *NatsNetConn) readFrameSize() int {
+	return limitFrame(maxFrameSize(c.nc), c.readLimit)
+}
+
+// writeFrameSize returns the largest number of bytes the connection sends with a single write request,
+// bounded by the max payload and by the write limit announced by the proxy.
+func (c *NatsNetConn) writeFrameSize() int {
+	return limitFrame(maxFrameSize(c.nc), c.writeLimit)
+}
+
+// limitFrame returns the frame size bounded by the limit, if the proxy announced one.
+func limitFrame(frame, limit int) int {
+	if limit > 0 {
+		return min(frame, limit)
+	}
+	return frame
+}
@@ -0,0 +1,147 @@
+// Package cmdutil holds the helpers shared by the commands of the module, such as the NATS connection settings.
+package cmdutil
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSConfig holds the settings of the connection to the NATS server.
+// The fields can be set by command line flags, see Register, or decoded from a configuration file.
+type NATSConfig struct {
+	// URL is the comma separated list of NATS server URLs.
+	URL string `json:"url"`
+	// Name is the connection name shown by the server monitoring.
+	Name string `json:"name"`
+	// Creds is the path of a user credentials file.
+	Creds string `json:"creds"`
+	// NKey is the path of an NKey seed file.
+	NKey string `json:"nkey"`
+	// User and Password authenticate with a user name and password.
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// Token authenticates with a token.
+	Token string `json:"token"`
+	// TLSCA is the path of the CA certificates verifying the server.
+	TLSCA string `json:"tlsCA"`
+	// TLSCert and TLSKey are the paths of the client certificate and its key.
+	TLSCert string `json:"tlsCert"`
+	TLSKey  string `json:"tlsKey"`
+}
+
+// natsFlag describes the command line flag of a NATSConfig field.
+type natsFlag struct {
+	name  string
+	env   string
+	usage string
+	value *string
+}
+
+// flags returns the command line flags of the fields of the configuration.
+func (c *NATSConfig) flags() []natsFlag {
+	return []natsFlag{
+		{"server", "NATS_URL", "NATS server URLs, separated by commas", &c.URL},
+		{"name", "", "NATS connection name", &c.Name},
+		{"creds", "NATS_CREDS", "NATS user credentials file", &c.Creds},
+		{"nkey", "NATS_NKEY", "NATS NKey seed file", &c.NKey},
+		{"user", "NATS_USER", "NATS user name", &c.User},
+		{"password", "NATS_PASSWORD", "NATS password", &c.Password},
+		{"token", "NATS_TOKEN", "NATS authentication token", &c.Token},
+		{"tlsca", "NATS_CA", "CA certificates verifying the NATS server", &c.TLSCA},
+		{"tlscert", "NATS_CERT", "client certificate for the NATS server", &c.TLSCert},
+		{"tlskey", "NATS_KEY", "client certificate key for the NATS server", &c.TLSKey},
+	}
+}
+
+// Register defines the flags setting the configuration on the flag set, with the connection name as the default name.
+// The defaults are taken from the environment variables used by the NATS command line tools, e.g. NATS_URL,
+// so secrets do not have to be passed on the command line.
+func (c *NATSConfig) Register(fs *flag.FlagSet, name string) {
+	for _, f := range c.flags() {
+		value, usage := os.Getenv(f.env), f.usage
+		if f.env != "" {
+			usage += " (env " + f.env + ")"
+		}
+		switch {
+		case f.name == "server" && value == "":
+			value = nats.DefaultURL
+		case f.name == "name":
+			value = name
+		}
+		fs.StringVar(f.value, f.name, value, usage)
+	}
+}
+
+// Override replaces the fields of the configuration with the values of the flags registered on the flag set,
+// if the flag was set on the command line or the field is empty. The flags must have been registered with flags.Register.
+func (c *NATSConfig) Override(flags *NATSConfig, fs *flag.FlagSet) {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	from := flags.flags()
+	for i, f := range c.flags() {
+		if set[f.name] || *f.value == "" {
+			*f.value = *from[i].value
+		}
+	}
+}
+
+// Options returns the NATS connection options for the configuration.
+// The connection reconnects forever, as the commands are long-running, and reports its state changes to the default logger.
+func (c *NATSConfig) Options() ([]nats.Option, error) {
+	options := []nats.Option{
+		nats.Name(c.Name),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("nats disconnected", "err", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("nats reconnected", "url", nc.ConnectedUrl())
+		}),
+	}
+	if c.Creds != "" {
+		options = append(options, nats.UserCredentials(c.Creds))
+	}
+	if c.NKey != "" {
+		opt, err := nats.NkeyOptionFromSeed(c.NKey)
+		if err != nil {
+			return nil, fmt.Errorf("load nkey: %w", err)
+		}
+		options = append(options, opt)
+	}
+	if c.User != "" {
+		options = append(options, nats.UserInfo(c.User, c.Password))
+	}
+	if c.Token != "" {
+		options = append(options, nats.Token(c.Token))
+	}
+	if c.TLSCA != "" {
+		options = append(options, nats.RootCAs(c.TLSCA))
+	}
+	if c.TLSCert != "" || c.TLSKey != "" {
+		options = append(options, nats.ClientCert(c.TLSCert, c.TLSKey))
+	}
+	return options, nil
+}
+
+// Connect connects to the NATS server with the configuration.
+func (c *NATSConfig) Connect() (*nats.Conn, error) {
+	options, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+	url := c.URL
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	nc, err := nats.Connect(url, options...)
+	if err != nil {
+		return nil, fmt.Errorf("connect to nats %s: %w", url, err)
+	}
+	return nc, nil
+}
@@ -0,0 +1,18 @@
+package netutil
+
+import "time"
+
+const (
+	// minAcceptDelay and maxAcceptDelay bound the delay before Accept is retried after an error, like in net/http.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// AcceptBackoff returns the delay before Accept is retried after an error, given the previous delay or zero after a success.
+// The delay doubles with every consecutive error, so a persistent error such as EMFILE does not spin the accept loop.
+func AcceptBackoff(previous time.Duration) time.Duration {
+	if previous == 0 {
+		return minAcceptDelay
+	}
+	return min(previous*2, maxAcceptDelay)
+}
@@ -0,0 +1,47 @@
+// Package netutil holds the network helpers shared by the commands and the SOCKS5 server of the module:
+// the copying of data between two connections and the backoff of accept loops.
+package netutil
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// closeWriter is implemented by connections that can close their write side only, e.g. *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Join copies data between the connections in both directions until both directions end, then closes them.
+// It returns the number of bytes copied from a to b and from b to a.
+//
+// When one direction ends, the write side of its destination is closed if the connection supports it, e.g. a NatsNetConn,
+// so the peer sees EOF while the data of the other direction keeps flowing; otherwise the destination is closed,
+// which ends the other direction too.
+func Join(a, b net.Conn) (sent, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent = copyHalf(b, a)
+	}()
+	go func() {
+		defer wg.Done()
+		received = copyHalf(a, b)
+	}()
+	wg.Wait()
+	_ = a.Close()
+	_ = b.Close()
+	return sent, received
+}
+
+// copyHalf copies src to dst and closes the write side of dst when src ends.
+func copyHalf(dst, src net.Conn) int64 {
+	n, _ := io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+		return n
+	}
+	_ = dst.Close()
+	return n
+}
@@ -0,0 +1,138 @@
+package net_conn_nats_proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/nats-io/nats.go"
+)
+
+// listenBacklog is the number of dialed connections waiting for Accept before further dials are refused.
+const listenBacklog = 128
+
+// listenerNetwork is the network name of the address of a NatsListener.
+const listenerNetwork = "nats"
+
+// _ is a variable of type net.Listener
+// It is used to assert that the type NatsListener implements the net.Listener interface.
+var _ net.Listener = &NatsListener{}
+
+// NatsListener is a net.Listener accepting the connections that clients dial over NATS on its subject.
+// It is the reverse of NatsConnProxy: instead of dialing the requested address, it hands the connection to the server calling Accept,
+// so a service without inbound network access can be exposed on a subject, e.g. with http.Serve(listener, handler).
+//
+// Clients dial the listener like a proxy, with NatsNetConn or NatsDialer on the same subject and a TCP network.
+// The address they dial is not resolved; it is the local address of the accepted connection,
+// so one listener can serve several names. Several listeners on the same subject share the dials like proxy instances do.
+type NatsListener struct {
+	addr  natsAddr
+	proxy *NatsConnProxy
+	pool  *NetConnPullManager
+	stop  context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+	conns  chan net.Conn
+	done   chan struct{}
+}
+
+// ListenNats returns a NatsListener accepting the connections dialed on the subject.
+// The options configure the proxy serving the connections, e.g. its limits, queue group and session lease;
+// by default clients may dial TCP networks only. The access policy and the resolver do not apply, as no address is dialed.
+func ListenNats(nc *nats.Conn, subject string, options ...ProxyOption) (*NatsListener, error) {
+	l := &NatsListener{
+		addr:  natsAddr{network: listenerNetwork, addr: subject},
+		conns: make(chan net.Conn, listenBacklog),
+		done:  make(chan struct{}),
+	}
+	options = append([]ProxyOption{WithNetworks("tcp", "tcp4", "tcp6")}, options...)
+	l.pool = NewNetConnPullManager(l.dial, WithPoolLogger(newProxyOptions(options...).log))
+	l.proxy = NewNatsConnProxy(nc, subject, l.pool, options...)
+	l.proxy.unresolved = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := l.proxy.Start(ctx); err != nil {
+		cancel()
+		_ = l.pool.Close()
+		return nil, err
+	}
+	l.stop = cancel
+	return l, nil
+}
+
+// dial is the dial function of the listener pool. It connects the session opened by the proxy to a new connection
+// queued for Accept, and refuses the dial if the listener is closed or Accept falls behind by more than the backlog.
+func (l *NatsListener) dial(network, addr string) (net.Conn, error) {
+	local := natsAddr{network: network, addr: addr}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: local, Err: syscall.ECONNREFUSED}
+	}
+	server, client := net.Pipe()
+	select {
+	case l.conns <- &listenerConn{Conn: server, local: local, remote: l.addr}:
+		return &listenerConn{Conn: client, local: l.addr, remote: local}, nil
+	default:
+		_ = server.Close()
+		_ = client.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: local, Err: syscall.ECONNREFUSED}
+	}
+}
+
+// Accept waits for and returns the next connection dialed on the subject.
+// It returns an error wrapping net.ErrClosed once the listener is closed.
+func (l *NatsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: listenerNetwork, Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close stops accepting connections and unsubscribes the listener from the subject.
+// The connections dialed but not accepted yet are closed. Unlike the connections of a TCP listener,
+// the accepted connections end too, as their sessions are served by the subscriptions of the listener.
+func (l *NatsListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return &net.OpError{Op: "close", Net: listenerNetwork, Addr: l.addr, Err: net.ErrClosed}
+	}
+	l.closed = true
+	close(l.done)
+	for len(l.conns) > 0 {
+		_ = (<-l.conns).Close()
+	}
+	l.mu.Unlock()
+
+	l.stop()
+	return l.pool.Close()
+}
+
+// Addr returns the address of the listener, the subject on the "nats" network.
+func (l *NatsListener) Addr() net.Addr {
+	return l.addr
+}
+
+// listenerConn is one end of the in-memory connection between the proxy session and the accepted connection,
+// reporting the addresses of the dial instead of the addresses of a pipe.
+type listenerConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *listenerConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the remote address of the connection.
+func (c *listenerConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -1,7 +1,6 @@
 package net_conn_nats_proxy
 
 import (
-	"fmt"
 	"log/slog"
 	"net"
 	"slices"
@@ -62,9 +61,11 @@ func NewDebugCustomLogNetConn(conn net.Conn, log DebugLogger) *DebugLogNetConn {
 
 // Read reads data from the underlying net.Conn into the provided byte slice.
 func (lc *DebugLogNetConn) Read(b []byte) (n int, err error) {
+	// the error is returned unwrapped, callers such as bufio compare it with io.EOF
 	read, err := lc.conn.Read(b)
 	if err != nil {
-		return 0, fmt.Errorf("read: %w", err)
+		lc.log.Debug("read", slog.Int("len", len(b)), slog.Int("read", read), slog.Any("err", err))
+		return read, err
 	}
 
 	bb := slices.Compact(slices.Clone(b))
@@ -1,11 +1,19 @@
 package net_conn_nats_proxy
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/nats-io/nats.go"
+	"io"
 	"net"
-	"slices"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -13,26 +21,337 @@ import (
 // It is used to assert that the type NatsNetConn implements the net.Conn interface.
 var _ net.Conn = &NatsNetConn{}
 
+// DefaultRequestTimeout is the default timeout of control requests such as Close and of the open handshake.
+const DefaultRequestTimeout = 5 * time.Second
+
+// DefaultReadBufferSize is the default number of bytes a Read requests from the proxy when streaming is disabled.
+const DefaultReadBufferSize = 32 * 1024
+
+// connOptions represents a struct for NatsNetConn options.
+type connOptions struct {
+	streaming      bool
+	receiveWindow  int
+	readBufferSize int
+	requestTimeout time.Duration
+	deadlineMargin time.Duration
+	writeRetries   int
+}
+
+// ConnOption represents a function type for setting NatsNetConn options.
+type ConnOption func(*connOptions)
+
+func newConnOptions(options ...ConnOption) *connOptions {
+	// create a default options instance
+	opts := &connOptions{
+		streaming:      true,
+		receiveWindow:  DefaultReceiveWindow,
+		readBufferSize: DefaultReadBufferSize,
+		requestTimeout: DefaultRequestTimeout,
+		deadlineMargin: DefaultDeadlineMargin,
+		writeRetries:   DefaultWriteRetries,
+	}
+	// apply the options
+	for _, opt := range options {
+		opt(opts)
+	}
+	return opts
+}
+
+// WithStreaming enables or disables the streaming mode.
+// In streaming mode the proxy pushes upstream data to the connection as it arrives and Read is served from a local buffer.
+// Otherwise, Read requests the data from the proxy, see WithReadBufferSize. Streaming is enabled by default.
+func WithStreaming(enabled bool) ConnOption {
+	return func(o *connOptions) {
+		o.streaming = enabled
+	}
+}
+
+// WithReceiveWindow sets the number of bytes the proxy may push ahead of Read in streaming mode.
+func WithReceiveWindow(size int) ConnOption {
+	return func(o *connOptions) {
+		if size > 0 {
+			o.receiveWindow = size
+		}
+	}
+}
+
+// WithReadBufferSize sets the number of bytes a Read requests from the proxy when streaming is disabled.
+// A Read with a smaller buffer keeps the rest of the reply for the following reads,
+// so small reads, e.g. of a bufio.Reader, do not cost a round trip each.
+func WithReadBufferSize(size int) ConnOption {
+	return func(o *connOptions) {
+		if size > 0 {
+			o.readBufferSize = size
+		}
+	}
+}
+
+// WithRequestTimeout sets the timeout of control requests such as Close,
+// and of the open handshake if it is not bounded by a context deadline.
+func WithRequestTimeout(timeout time.Duration) ConnOption {
+	return func(o *connOptions) {
+		o.requestTimeout = timeout
+	}
+}
+
+// WithDeadlineMargin sets the extra time the connection waits for the reply of a read or write bounded by a deadline.
+// The proxy applies the deadline to the upstream connection and replies with a timeout error when it passes;
+// the margin covers the round trip, so that reply arrives before the request itself times out.
+func WithDeadlineMargin(margin time.Duration) ConnOption {
+	return func(o *connOptions) {
+		o.deadlineMargin = margin
+	}
+}
+
+// WithWriteRetries sets how many times a write frame is sent again after a transient failure,
+// such as a lost reply or a busy proxy, before a Write with a deadline gives up.
+// A Write without a deadline sends the frame again until the proxy handles it or the connection is closed.
+func WithWriteRetries(n int) ConnOption {
+	return func(o *connOptions) {
+		o.writeRetries = n
+	}
+}
+
 // NatsNetConn is a type that wraps a nats.Conn and provides methods for reading, writing, closing,
 // and managing deadlines on network connections.
+// Like any net.Conn, it may be used by several goroutines at once.
 type NatsNetConn struct {
 	nc      *nats.Conn
 	subject string
-	addr    *net.TCPAddr
+	addr    net.Addr
 	uuid    string
+	opts    *connOptions
+
+	session        string
+	sessionSubject string
+	localAddr      net.Addr
+	remoteAddr     net.Addr
+	stopKeepalive  context.CancelFunc
+	// readLimit and writeLimit are the request size limits announced by the proxy, zero if it announced none.
+	readLimit  int
+	writeLimit int
+
+	readDeadLine  connDeadline
+	writeDeadLine connDeadline
+	// closed is set by the first Close, done is closed by it to interrupt pending reads and writes.
+	closed atomic.Bool
+	done   chan struct{}
+
+	// readMu serializes the reads requested from the proxy and guards readBuf and readOffset.
+	readMu sync.Mutex
+	// readBuf keeps the data of a read reply that did not fit into the buffer of the caller.
+	readBuf bytes.Buffer
+	// readOffset is the number of bytes received by read replies, which acknowledges them to the proxy.
+	readOffset uint64
+	// writeMu serializes writes and guards writeSeq and pendingWrite.
+	writeMu sync.Mutex
+	// writeSeq is the sequence number of the last write frame, pendingWrite the frame the proxy has not acknowledged yet.
+	writeSeq     uint64
+	pendingWrite *writeFrame
+	// canCloseWrite reports whether the proxy supports CloseWrite, writeClosed whether it was called.
+	canCloseWrite bool
+	writeClosed   bool
 
-	readDeadLine  time.Time
-	writeDeadLine time.Time
+	streamMu  sync.Mutex
+	stream    *streamBuffer
+	streamSub *nats.Subscription
+	// datagrams receives the datagrams pushed to a NatsPacketConn.
+	datagrams *datagramQueue
 }
 
 // NewNatsNetConn returns a new NatsNetConn instance.
-func NewNatsNetConn(nc *nats.Conn, subject string, addr *net.TCPAddr) (*NatsNetConn, error) {
+// It opens a session on the proxy, which dials the upstream address right away,
+// so an unreachable address or a missing proxy is reported here rather than by the first Read or Write.
+// The open handshake is bounded by the request timeout, see NewNatsNetConnContext to control it with a context.
+func NewNatsNetConn(nc *nats.Conn, subject string, addr *net.TCPAddr, options ...ConnOption) (*NatsNetConn, error) {
+	return NewNatsNetConnContext(context.Background(), nc, subject, addr, options...)
+}
+
+// NewNatsNetConnContext returns a new NatsNetConn instance like NewNatsNetConn.
+// The context governs the open handshake: the proxy must reply before the context is done.
+// If the context has no deadline, the request timeout applies.
+func NewNatsNetConnContext(ctx context.Context, nc *nats.Conn, subject string, addr *net.TCPAddr, options ...ConnOption) (*NatsNetConn, error) {
+	return newNatsNetConn(ctx, nc, subject, addr, options...)
+}
+
+// DialNatsNetConn returns a new NatsNetConn instance connected to the address on the named network.
+// The address is sent to the proxy unchanged, so host names are resolved by the proxy in its own network
+// and may be names that the client cannot resolve, e.g. a Kubernetes service name.
+// The context governs the open handshake like in NewNatsNetConnContext.
+func DialNatsNetConn(ctx context.Context, nc *nats.Conn, subject, network, address string, options ...ConnOption) (*NatsNetConn, error) {
+	return newNatsNetConn(ctx, nc, subject, natsAddr{network: network, addr: address}, options...)
+}
+
+// newNatsNetConn creates the NatsNetConn instance and opens its session on the proxy.
+func newNatsNetConn(ctx context.Context, nc *nats.Conn, subject string, addr net.Addr, options ...ConnOption) (*NatsNetConn, error) {
 	// generate a UUID for the connection to prevent message collisions
 	uuid, err := _UUIDFromCryptoRand()
 	if err != nil {
 		return nil, fmt.Errorf("generate uuid: %w", err)
 	}
-	return &NatsNetConn{nc: nc, subject: subject, addr: addr, uuid: uuid}, nil
+	c := &NatsNetConn{nc: nc, subject: subject, addr: addr, uuid: uuid, opts: newConnOptions(options...), done: make(chan struct{})}
+	if err = c.dial(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial sends the open handshake to the proxy.
+// The proxy replies with the session ID used by all further requests, the addresses of the upstream connection
+// and the capabilities both sides support. In streaming mode the stream inbox is announced in the same request.
+func (c *NatsNetConn) dial(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.requestTimeout)
+		defer cancel()
+	}
+
+	newMsg := nats.NewMsg(c.subject + dialSuffix)
+	newMsg.Header.Set(networkHeaderKey, c.addr.Network())
+	newMsg.Header.Set(addrHeaderKey, c.addr.String())
+	newMsg.Header.Set(connectionUUIDHeaderKey, c.uuid)
+
+	var sb *streamBuffer
+	var sub *nats.Subscription
+	var caps []string
+	switch {
+	case c.opts.streaming && c.datagrams != nil:
+		var err error
+		if sub, err = c.subscribeDatagrams(); err != nil {
+			return c.requestError("dial", err)
+		}
+		caps = append(caps, capDatagram)
+		newMsg.Header.Set(inboxHeaderKey, sub.Subject)
+	case c.opts.streaming:
+		var err error
+		if sb, sub, err = c.subscribeStream(); err != nil {
+			return c.requestError("dial", err)
+		}
+		caps = append(caps, capStream)
+		newMsg.Header.Set(inboxHeaderKey, sub.Subject)
+		newMsg.Header.Set(windowHeaderKey, strconv.Itoa(c.opts.receiveWindow))
+	}
+	if c.datagrams == nil {
+		caps = append(caps, capCloseWrite)
+	}
+	newMsg.Header.Set(capsHeaderKey, strings.Join(caps, ","))
+	unsubscribe := func() {
+		if sub != nil {
+			_ = sub.Unsubscribe()
+		}
+	}
+
+	msg, err := c.nc.RequestMsgWithContext(ctx, newMsg)
+	if err != nil {
+		unsubscribe()
+		return c.requestError("dial", err)
+	}
+	if err = c.replyError("dial", msg); err != nil {
+		unsubscribe()
+		return err
+	}
+	c.session = msg.Header.Get(sessionHeaderKey)
+	// further requests go to the proxy instance that holds the session
+	c.sessionSubject = msg.Header.Get(sessionSubjectHeaderKey)
+	if c.sessionSubject == "" {
+		c.sessionSubject = c.subject
+	}
+	c.readLimit, _ = strconv.Atoi(msg.Header.Get(readLimitHeaderKey))
+	c.writeLimit, _ = strconv.Atoi(msg.Header.Get(writeLimitHeaderKey))
+	c.localAddr = parseAddr(c.addr.Network(), msg.Header.Get(localAddrHeaderKey))
+	c.remoteAddr = parseAddr(c.addr.Network(), msg.Header.Get(remoteAddrHeaderKey))
+	granted := msg.Header.Get(capsHeaderKey)
+	c.canCloseWrite = hasCap(granted, capCloseWrite)
+	switch {
+	case sb != nil && hasCap(granted, capStream):
+		c.stream, c.streamSub = sb, sub
+	case c.datagrams != nil && hasCap(granted, capDatagram):
+		c.streamSub = sub
+	default:
+		// the proxy does not push, reads use request/reply
+		unsubscribe()
+		c.datagrams = nil
+	}
+	if lease, err := strconv.ParseInt(msg.Header.Get(leaseHeaderKey), 10, 64); err == nil && lease > 0 {
+		var keepaliveCtx context.Context
+		keepaliveCtx, c.stopKeepalive = context.WithCancel(context.Background())
+		ka := &sessionKeepalive{
+			nc:        c.nc,
+			subject:   c.sessionSubject + keepaliveSuffix,
+			session:   c.session,
+			timeout:   c.opts.requestTimeout,
+			stream:    c.stream,
+			datagrams: c.datagrams,
+		}
+		go ka.run(keepaliveCtx, time.Duration(lease)*time.Millisecond)
+	}
+	// a connection dropped without Close stops renewing its lease, so the proxy reaps the session
+	runtime.AddCleanup(c, func(r connResources) { r.release() }, connResources{stopKeepalive: c.stopKeepalive, streamSub: c.streamSub})
+	return nil
+}
+
+// connResources are the resources of a NatsNetConn that outlive it unless they are released:
+// the keepalive goroutine and the subscription of the pushed data. They do not reference the connection,
+// so they are released by a cleanup once a connection that was never closed is garbage collected.
+type connResources struct {
+	stopKeepalive context.CancelFunc
+	streamSub     *nats.Subscription
+}
+
+// release stops the keepalive and unsubscribes from the pushed data.
+func (r connResources) release() {
+	if r.stopKeepalive != nil {
+		r.stopKeepalive()
+	}
+	if r.streamSub != nil {
+		_ = r.streamSub.Unsubscribe()
+	}
+}
+
+// sessionKeepalive renews the lease of a session on the proxy, so the session survives periods without traffic.
+// It does not reference the NatsNetConn, which keeps a connection that is no longer used collectable.
+type sessionKeepalive struct {
+	nc      *nats.Conn
+	subject string
+	session string
+	timeout time.Duration
+	// stream and datagrams are failed once the session is gone, so pending reads return.
+	stream    *streamBuffer
+	datagrams *datagramQueue
+}
+
+// run renews the lease until the context is done or the session is gone.
+func (ka *sessionKeepalive) run(ctx context.Context, lease time.Duration) {
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		newMsg := nats.NewMsg(ka.subject)
+		newMsg.Header.Set(sessionHeaderKey, ka.session)
+		if ka.stream != nil {
+			// repairs the credit of a lost credit message, see grantCredit
+			newMsg.Header.Set(consumedHeaderKey, strconv.FormatUint(ka.stream.reportedOffset(), 10))
+		}
+		msg, err := ka.nc.RequestMsg(newMsg, ka.timeout)
+		if err == nil {
+			err = remoteError(msg)
+		}
+		// no responders means the proxy instance holding the session is gone, see requestError
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, nats.ErrNoResponders) || errors.Is(err, nats.ErrConnectionClosed) {
+			if ka.stream != nil {
+				ka.stream.fail(net.ErrClosed)
+			}
+			if ka.datagrams != nil {
+				ka.datagrams.fail(net.ErrClosed)
+			}
+			return
+		}
+	}
 }
 
 const (
@@ -40,89 +359,169 @@ const (
 	addrHeaderKey           = "addr"
 	errHeaderKey            = "err"
 	readSizeHeaderKey       = "read-size"
-	readDeadlineHeaderKey   = "read-deadline"
-	writeDeadlineHeaderKey  = "write-deadline"
 	connectionUUIDHeaderKey = "conn-uuid"
 )
 
 const readSuffix = ".read"
 
 // Read reads data from the underlying nats.Conn into the provided byte slice.
+// In streaming mode the data is taken from the local buffer filled by the proxy,
+// otherwise it is requested from the proxy. A request asks for at least the read buffer size,
+// and the data that does not fit into b is kept for the following reads, which are served without a round trip.
+// Without a read deadline, Read blocks until data arrives. Close and SetReadDeadline interrupt a pending Read.
 func (c *NatsNetConn) Read(b []byte) (n int, err error) {
-	newMsg := nats.NewMsg(c.subject + readSuffix)
-	newMsg.Header.Set(readSizeHeaderKey, fmt.Sprintf("%d", len(b)))
-	newMsg.Header.Set(networkHeaderKey, c.addr.Network())
-	newMsg.Header.Set(addrHeaderKey, c.addr.String())
-	newMsg.Header.Set(readDeadlineHeaderKey, c.readDeadLine.Format(time.RFC3339Nano))
-	newMsg.Header.Set(connectionUUIDHeaderKey, c.uuid)
+	if c.closed.Load() {
+		return 0, c.wrapError("read", net.ErrClosed)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if c.stream != nil {
+		return c.readStream(b)
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
 
-	rd := time.Until(c.readDeadline())
-	msg, err := c.nc.RequestMsg(newMsg, rd)
-	if err != nil {
-		return 0, fmt.Errorf("nats request: %w", err)
+	if c.closed.Load() {
+		// the connection was closed while the read waited for a concurrent one
+		return 0, c.wrapError("read", net.ErrClosed)
 	}
-	msgErr := msg.Header.Get(errHeaderKey)
-	if msgErr != "" {
-		return 0, fmt.Errorf("nats error: %s", msgErr)
+	if c.readBuf.Len() > 0 {
+		return c.readBuf.Read(b)
 	}
-	if len(msg.Data) > len(b) {
-		return 0, fmt.Errorf("message too long")
+	msg, err := c.requestRead(func(timeout time.Time) *nats.Msg {
+		newMsg := nats.NewMsg(c.sessionSubject + readSuffix)
+		// a read returns at most one frame, larger buffers are filled by the following reads
+		newMsg.Header.Set(readSizeHeaderKey, fmt.Sprintf("%d", min(max(len(b), c.opts.readBufferSize), c.readFrameSize())))
+		setTimeoutHeader(newMsg.Header, readTimeoutHeaderKey, timeout)
+		newMsg.Header.Set(sessionHeaderKey, c.session)
+		// the proxy sends the data of a reply that was lost again
+		newMsg.Header.Set(readOffsetHeaderKey, strconv.FormatUint(c.readOffset, 10))
+		return newMsg
+	})
+	if err != nil {
+		return 0, err
 	}
-	copy(b, msg.Data)
-	return len(msg.Data), nil
+	c.readOffset += uint64(len(msg.Data))
+	n = copy(b, msg.Data)
+	c.readBuf.Write(msg.Data[n:])
+	return n, nil
 }
 
 const writeSuffix = ".write"
 
 // Write writes the provided byte slice to the underlying nats.Conn.
+// Data larger than the NATS max payload or the write limit of the proxy is sent in several frames, which the proxy writes in order.
+// Like for any net.Conn, Write returns an error if it writes less than len(b).
+//
+// Every frame carries a sequence number, so a frame whose request failed transiently is sent again without being written twice.
+// A frame that is still unacknowledged when Write gives up is counted as written: it is sent again before any later data,
+// like data left in the send buffer of a socket.
 func (c *NatsNetConn) Write(b []byte) (n int, err error) {
-	newMsg := nats.NewMsg(c.subject + writeSuffix)
-	newMsg.Header.Set(networkHeaderKey, c.addr.Network())
-	newMsg.Header.Set(addrHeaderKey, c.addr.String())
-	newMsg.Header.Set(writeDeadlineHeaderKey, c.writeDeadLine.Format(time.RFC3339Nano))
-	newMsg.Header.Set(connectionUUIDHeaderKey, c.uuid)
-	newMsg.Data = slices.Clone(b)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 
-	rd := time.Until(c.writeDeadline())
-	msg, err := c.nc.RequestMsg(newMsg, rd)
-	if err != nil {
-		return 0, fmt.Errorf("nats request: %w", err)
+	if c.closed.Load() {
+		return 0, c.wrapError("write", net.ErrClosed)
 	}
-	msgErr := msg.Header.Get(errHeaderKey)
-	if msgErr != "" {
-		return 0, fmt.Errorf("nats error: %s", msgErr)
+	if c.writeClosed {
+		// like a socket whose write side was shut down
+		return 0, c.wrapError("write", syscall.EPIPE)
 	}
-	wl, err := strconv.Atoi(string(msg.Data))
-	if err != nil {
-		return 0, fmt.Errorf("parse write length: %w", err)
+	if err = c.flushPendingWrite(); err != nil {
+		return 0, err
+	}
+	frame := c.writeFrameSize()
+	for {
+		chunk := b[n:min(n+frame, len(b))]
+		wn, err := c.write(chunk, "")
+		n += wn
+		if err != nil {
+			return n, err
+		}
+		if wn < len(chunk) {
+			return n, c.wrapError("write", io.ErrShortWrite)
+		}
+		if n >= len(b) {
+			return n, nil
+		}
 	}
-	return wl, nil
 }
 
 const closeSuffix = ".close"
 
+// Close ends the session on the proxy, which closes the upstream connection.
+// Pending reads and writes are interrupted and fail with net.ErrClosed, like any later call, including a second Close.
 func (c *NatsNetConn) Close() error {
-	newMsg := nats.NewMsg(c.subject + closeSuffix)
-	newMsg.Header.Set(networkHeaderKey, c.addr.Network())
-	newMsg.Header.Set(addrHeaderKey, c.addr.String())
-	newMsg.Header.Set(connectionUUIDHeaderKey, c.uuid)
+	if c.closed.Swap(true) {
+		return c.wrapError("close", net.ErrClosed)
+	}
+	defer c.stopStream()
+	if c.stopKeepalive != nil {
+		c.stopKeepalive()
+	}
+	// data already reported as written is delivered before the session ends, if the proxy is still reachable;
+	// a Write in progress is interrupted instead, so Close does not wait for it
+	if c.writeMu.TryLock() {
+		_ = c.flushPendingWrite()
+		c.writeMu.Unlock()
+	}
+	// interrupt pending reads and writes
+	close(c.done)
 
-	msg, err := c.nc.RequestMsg(newMsg, time.Second)
+	newMsg := nats.NewMsg(c.sessionSubject + closeSuffix)
+	newMsg.Header.Set(sessionHeaderKey, c.session)
+
+	msg, err := c.nc.RequestMsg(newMsg, c.opts.requestTimeout)
 	if err != nil {
-		return fmt.Errorf("nats request: %w", err)
+		return c.requestError("close", err)
 	}
-	msgErr := msg.Header.Get(errHeaderKey)
-	if msgErr != "" {
-		return fmt.Errorf("nats error: %s", msgErr)
+	if ErrorCode(msg.Header.Get(errCodeHeaderKey)) == ErrCodeClosed {
+		// the proxy already ended the session, e.g. after the upstream peer closed the connection
+		return nil
 	}
-	return nil
+	return c.replyError("close", msg)
+}
+
+// CloseWrite closes the write side of the upstream connection, like (*net.TCPConn).CloseWrite:
+// the upstream peer reads EOF once the data written before has been delivered, while Read keeps receiving its data.
+// Later writes fail. It returns an error wrapping errors.ErrUnsupported if the proxy or the upstream connection
+// does not support closing the write side; the connection is still writable then, like after any failed CloseWrite.
+func (c *NatsNetConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	switch {
+	case c.closed.Load():
+		return c.wrapError("close", net.ErrClosed)
+	case !c.canCloseWrite:
+		return c.wrapError("close", errors.ErrUnsupported)
+	case c.writeClosed:
+		return nil
+	}
+	if err := c.flushPendingWrite(); err != nil {
+		return err
+	}
+	_, err := c.sendNext(&writeFrame{closeWrite: true})
+	// an error reply leaves the write side open; an unacknowledged frame is pending and sent again by Close,
+	// so its outcome is unknown and the write side counts as closed
+	if err == nil || c.pendingWrite != nil {
+		c.writeClosed = true
+	}
+	return err
 }
 
+// LocalAddr returns the local address of the upstream connection opened by the proxy.
 func (c *NatsNetConn) LocalAddr() net.Addr {
-	return nil
+	return c.localAddr
 }
 
+// RemoteAddr returns the address the proxy is connected to.
+// It is the address resolved by the proxy, not the host name requested by the client.
 func (c *NatsNetConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
 	return c.addr
 }
 
@@ -136,20 +535,30 @@ func (c *NatsNetConn) SetDeadline(t time.Time) error {
 	return nil
 }
 
+// SetReadDeadline sets the deadline of Read. A pending Read observes the new deadline right away.
 func (c *NatsNetConn) SetReadDeadline(t time.Time) error {
-	c.readDeadLine = t
+	if c.closed.Load() {
+		return c.wrapError("set", net.ErrClosed)
+	}
+	c.readDeadLine.set(t)
 	return nil
 }
 
 func (c *NatsNetConn) writeDeadline() time.Time {
-	return c.writeDeadLine
+	t, _ := c.writeDeadLine.get()
+	return t
 }
 
+// SetWriteDeadline sets the deadline of Write. A pending Write observes the new deadline right away.
 func (c *NatsNetConn) SetWriteDeadline(t time.Time) error {
-	c.writeDeadLine = t
+	if c.closed.Load() {
+		return c.wrapError("set", net.ErrClosed)
+	}
+	c.writeDeadLine.set(t)
 	return nil
 }
 
 func (c *NatsNetConn) readDeadline() time.Time {
-	return c.readDeadLine
+	t, _ := c.readDeadLine.get()
+	return t
 }
@@ -2,17 +2,217 @@ package net_conn_nats_proxy
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
 	"net"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
 )
 
+const (
+	// DefaultMaxWorkers is the default number of requests of each kind the proxy executes concurrently, see WithMaxWorkers.
+	DefaultMaxWorkers = 1024
+	// DefaultMaxPending is the default number of requests of each kind the proxy queues while waiting for a worker.
+	DefaultMaxPending = 65536
+	// DefaultResolveTimeout is the default time the proxy waits for the resolution of a destination.
+	DefaultResolveTimeout = 10 * time.Second
+	// DefaultQueueGroup is the default queue group the proxy instances join to share dial requests.
+	DefaultQueueGroup = "net-conn-nats-proxy"
+	// DefaultSessionLease is the default time a session is kept open without activity or a keepalive from the client.
+	DefaultSessionLease = 2 * time.Minute
+)
+
+// proxyOptions represents a struct for NatsConnProxy options.
+type proxyOptions struct {
+	maxWorkers      int
+	maxPending      int
+	pendingMsgs     int
+	pendingBytes    int
+	log             *slog.Logger
+	resolver        Resolver
+	resolveTimeout  time.Duration
+	sessionLease    time.Duration
+	policy          *AccessPolicy
+	queueGroup      string
+	instanceID      string
+	maxReadSize     int
+	maxWriteSize    int
+	maxHeaderLength int
+	networks        []string
+}
+
+// ProxyOption represents a function type for setting NatsConnProxy options.
+type ProxyOption func(*proxyOptions)
+
+func newProxyOptions(options ...ProxyOption) *proxyOptions {
+	// create a default options instance
+	opts := &proxyOptions{
+		maxWorkers:      DefaultMaxWorkers,
+		maxPending:      DefaultMaxPending,
+		pendingMsgs:     nats.DefaultSubPendingMsgsLimit,
+		pendingBytes:    nats.DefaultSubPendingBytesLimit,
+		log:             slog.Default(),
+		resolveTimeout:  DefaultResolveTimeout,
+		sessionLease:    DefaultSessionLease,
+		queueGroup:      DefaultQueueGroup,
+		maxReadSize:     DefaultMaxReadSize,
+		maxWriteSize:    DefaultMaxWriteSize,
+		maxHeaderLength: DefaultMaxHeaderLength,
+		networks:        DefaultNetworks,
+	}
+	// apply the options
+	for _, opt := range options {
+		opt(opts)
+	}
+	if opts.resolver == nil {
+		opts.resolver = NewCachingResolver(nil, DefaultResolveCacheTTL)
+	}
+	if opts.policy == nil {
+		opts.policy = &AccessPolicy{}
+	}
+	if opts.instanceID == "" {
+		// crypto/rand never fails, see rand.Read
+		opts.instanceID, _ = _UUIDFromCryptoRand()
+	}
+	return opts
+}
+
+// WithMaxWorkers sets the number of requests of each kind the proxy executes concurrently.
+// Writes and the other requests, such as dials and closes, have separate worker pools of this size.
+// Reads do not take a worker, as they mostly wait for upstream data, often as long polls of idle sessions:
+// the reads of a session are executed one at a time, which bounds them by the number of sessions.
+// Requests of the same kind of one session are still executed in order.
+func WithMaxWorkers(n int) ProxyOption {
+	return func(o *proxyOptions) {
+		o.maxWorkers = n
+	}
+}
+
+// WithMaxPending sets the number of requests of each kind the proxy queues while all workers of the kind are busy.
+// Requests above the limit are rejected with ErrProxyBusy.
+func WithMaxPending(n int) ProxyOption {
+	return func(o *proxyOptions) {
+		o.maxPending = n
+	}
+}
+
+// WithSubscriptionPendingLimits sets the pending message and byte limits of the proxy subscriptions.
+// Messages dropped by NATS because of these limits are reported to the proxy logger.
+func WithSubscriptionPendingLimits(msgs, bytes int) ProxyOption {
+	return func(o *proxyOptions) {
+		o.pendingMsgs = msgs
+		o.pendingBytes = bytes
+	}
+}
+
+// WithProxyLogger sets the logger used by the proxy to report dropped and rejected requests.
+func WithProxyLogger(log *slog.Logger) ProxyOption {
+	return func(o *proxyOptions) {
+		o.log = log
+	}
+}
+
+// WithResolver sets the resolver the proxy uses to resolve the destinations requested by clients.
+// By default, a CachingResolver backed by net.DefaultResolver is used.
+func WithResolver(resolver Resolver) ProxyOption {
+	return func(o *proxyOptions) {
+		o.resolver = resolver
+	}
+}
+
+// WithResolveTimeout sets the time the proxy waits for the resolution of a destination.
+func WithResolveTimeout(timeout time.Duration) ProxyOption {
+	return func(o *proxyOptions) {
+		o.resolveTimeout = timeout
+	}
+}
+
+// WithSessionLease sets the time a session is kept open without activity on the upstream connection or a keepalive from the client.
+// Clients are told the lease when they open a session and send keepalives well within it,
+// until the connection is closed or garbage collected.
+// Sessions of crashed clients, or of clients that never close them, are closed once the lease expires.
+func WithSessionLease(lease time.Duration) ProxyOption {
+	return func(o *proxyOptions) {
+		o.sessionLease = lease
+	}
+}
+
+// WithAccessPolicy sets the policy deciding which destinations clients may reach.
+// By default, loopback and link-local destinations are denied and all other destinations are allowed.
+func WithAccessPolicy(policy *AccessPolicy) ProxyOption {
+	return func(o *proxyOptions) {
+		o.policy = policy
+	}
+}
+
+// WithQueueGroup sets the queue group the proxy joins for dial requests.
+// Proxy instances on the same subject and queue group share the dial requests, so each session is opened by exactly one of them.
+func WithQueueGroup(group string) ProxyOption {
+	return func(o *proxyOptions) {
+		o.queueGroup = group
+	}
+}
+
+// WithInstanceID sets the ID of the proxy instance, which is part of the subject its sessions are served on.
+// The ID must be a valid NATS subject token and unique among the instances on the subject. By default, a random ID is used.
+func WithInstanceID(id string) ProxyOption {
+	return func(o *proxyOptions) {
+		o.instanceID = id
+	}
+}
+
+// WithMaxReadSize sets the largest number of bytes a client may request with a single read.
+// Larger requests are rejected with ErrInvalidRequest. Clients learn the limit when they open a session and stay below it.
+func WithMaxReadSize(size int) ProxyOption {
+	return func(o *proxyOptions) {
+		o.maxReadSize = size
+	}
+}
+
+// WithMaxWriteSize sets the largest payload of a single write request.
+// Larger requests are rejected with ErrInvalidRequest. Clients learn the limit when they open a session and split larger writes.
+func WithMaxWriteSize(size int) ProxyOption {
+	return func(o *proxyOptions) {
+		o.maxWriteSize = size
+	}
+}
+
+// WithMaxHeaderLength sets the largest length of a request header value.
+// Requests with longer headers are rejected with ErrInvalidRequest.
+func WithMaxHeaderLength(length int) ProxyOption {
+	return func(o *proxyOptions) {
+		o.maxHeaderLength = length
+	}
+}
+
+// WithNetworks sets the networks clients may dial, see DefaultNetworks.
+// Dial requests for other networks are rejected with ErrInvalidRequest.
+func WithNetworks(networks ...string) ProxyOption {
+	return func(o *proxyOptions) {
+		o.networks = networks
+	}
+}
+
+// droppedCheckInterval is the interval at which the proxy checks its subscriptions for dropped messages.
+const droppedCheckInterval = time.Second
+
 // NatsConnProxy represents a proxy for NATS connections.
 // It is responsible for handling read and write requests from NATS messages and forwarding them to the appropriate network connections.
 // NatsConnProxy uses the NetConnManager interface to manage network connections from a pool or create new ones.
 // The proxy starts handling requests by calling the Start method, which takes a context.Context as a parameter and returns an error if any occurs.
+// Requests are executed concurrently on bounded pools of workers, one for writes and one for the other requests,
+// while reads, which wait for upstream data, run without a worker limit, so idle long polls never delay other requests.
+// Requests of the same kind of a single session keep their order,
+// requests of different kinds do not: a close does not wait for a pending read of its session, it interrupts it.
+// A session is opened by a dial request, which dials the upstream address eagerly and assigns the session ID used by all further requests.
+// Streaming clients receive the upstream data pushed to their inbox instead of requesting every read.
+//
+// Several proxies can serve the same subject: dial requests are load balanced within a queue group,
+// and the requests of an open session go to the instance that opened it, on a subject that includes the instance ID.
 //
 // Example usage:
 //
@@ -22,6 +222,17 @@ type NatsConnProxy struct {
 	nc       *nats.Conn
 	subject  string
 	connPool NetConnManager
+	opts     *proxyOptions
+	// reads, writes and control execute the read requests, the write requests and all other requests,
+	// separately so blocking upstream reads and writes cannot take the workers of the other kinds;
+	// reads are not limited by workers, a session has at most one read in progress
+	reads    *dispatcher
+	writes   *dispatcher
+	control  *dispatcher
+	sessions *sessionRegistry
+	// unresolved passes the addresses to the connection pool as requested by the client,
+	// without resolving them or checking them against the access policy; set by NatsListener, which does not dial them.
+	unresolved bool
 
 	stopHandler func()
 }
@@ -34,13 +245,24 @@ type NatsConnProxy struct {
 // - nc: The NATS connection to use for communication.
 // - subject: The subject to listen for NATS messages on.
 // - connPool: The connection pool to use for network connections.
+// - options: Optional settings such as the worker pool size and pending limits.
 //
 // Returns:
 // - *NatsConnProxy: The created NatsConnProxy instance.
-func NewNatsConnProxy(nc *nats.Conn, subject string, connPool NetConnManager) *NatsConnProxy {
-	ncp := &NatsConnProxy{nc: nc, subject: subject, connPool: connPool}
+func NewNatsConnProxy(nc *nats.Conn, subject string, connPool NetConnManager, options ...ProxyOption) *NatsConnProxy {
+	opts := newProxyOptions(options...)
+	ncp := &NatsConnProxy{
+		nc:       nc,
+		subject:  subject,
+		connPool: connPool,
+		opts:     opts,
+		reads:    newDispatcher(-1, opts.maxPending),
+		writes:   newDispatcher(opts.maxWorkers, opts.maxPending),
+		control:  newDispatcher(opts.maxWorkers, opts.maxPending),
+		sessions: newSessionRegistry(),
+	}
 	if connPool == nil {
-		ncp.connPool = NewNetConnPullManager(DefaultDial)
+		ncp.connPool = NewNetConnPullManager(DefaultDial, WithPoolLogger(opts.log))
 		ncp.stopHandler = func() { _ = ncp.connPool.Close() }
 	}
 	return ncp
@@ -54,23 +276,48 @@ func NewNatsConnProxy(nc *nats.Conn, subject string, connPool NetConnManager) *N
 // Returns:
 // - error: An error if there was a problem subscribing to the NATS messages, otherwise nil.
 func (ncp NatsConnProxy) Start(ctx context.Context) error {
-	readSub, err := ncp.nc.Subscribe(ncp.subject+readSuffix, ncp.readHandler)
-	if err != nil {
-		return err
+	sessionSubject := ncp.sessionSubject()
+	handlers := []struct {
+		subject string
+		queue   string
+		op      string
+		handler nats.MsgHandler
+	}{
+		{ncp.subject + dialSuffix, ncp.opts.queueGroup, dialSuffix, ncp.dialHandler},
+		{sessionSubject + readSuffix, "", readSuffix, ncp.readHandler},
+		{sessionSubject + writeSuffix, "", writeSuffix, ncp.writeHandler},
+		{sessionSubject + closeSuffix, "", closeSuffix, ncp.closeHandler},
+		{sessionSubject + creditSuffix, "", creditSuffix, ncp.creditHandler},
+		{sessionSubject + keepaliveSuffix, "", keepaliveSuffix, ncp.keepaliveHandler},
 	}
-	writeSub, err := ncp.nc.Subscribe(ncp.subject+writeSuffix, ncp.writeHandler)
-	if err != nil {
-		return err
+	subs := make([]*nats.Subscription, 0, len(handlers))
+	unsubscribe := func() {
+		for _, sub := range subs {
+			_ = sub.Unsubscribe()
+		}
 	}
-	closeSub, err := ncp.nc.Subscribe(ncp.subject+closeSuffix, ncp.closeHandler)
-	if err != nil {
-		return err
+	for _, h := range handlers {
+		// an empty queue group subscribes every instance
+		sub, err := ncp.nc.QueueSubscribe(h.subject, h.queue, ncp.dispatchHandler(h.op, h.handler))
+		if err != nil {
+			unsubscribe()
+			return err
+		}
+		if err = sub.SetPendingLimits(ncp.opts.pendingMsgs, ncp.opts.pendingBytes); err != nil {
+			unsubscribe()
+			_ = sub.Unsubscribe()
+			return err
+		}
+		subs = append(subs, sub)
 	}
+	go ncp.watchDropped(ctx, subs)
 	go func() {
 		<-ctx.Done()
-		_ = readSub.Unsubscribe()
-		_ = writeSub.Unsubscribe()
-		_ = closeSub.Unsubscribe()
+		unsubscribe()
+		ncp.reads.close()
+		ncp.writes.close()
+		ncp.control.close()
+		ncp.sessions.stopAll()
 		if ncp.stopHandler != nil {
 			ncp.stopHandler()
 		}
@@ -78,110 +325,388 @@ func (ncp NatsConnProxy) Start(ctx context.Context) error {
 	return nil
 }
 
-// readHandler processes a read request from a NATS message and retrieves data from the corresponding network connection.
-func (ncp NatsConnProxy) readHandler(msg *nats.Msg) {
+// sessionSubject returns the subject prefix of the requests for the sessions opened by this instance.
+func (ncp NatsConnProxy) sessionSubject() string {
+	return ncp.subject + "." + ncp.opts.instanceID
+}
+
+// dispatchHandler wraps the handler so that messages are validated and then executed by the dispatcher of the operation
+// instead of the NATS subscription goroutine.
+// Messages of the same session and operation share a lane, so they are handled in the order they arrived.
+// Dial requests are keyed by the connection UUID of the client, as the session does not exist yet.
+// If the dispatcher cannot accept the message, the requester receives an error reply.
+func (ncp NatsConnProxy) dispatchHandler(op string, handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		key := msg.Header.Get(sessionHeaderKey)
+		if key == "" {
+			key = msg.Header.Get(connectionUUIDHeaderKey)
+		}
+		key += op
+		if err := ncp.validateRequest(op, msg); err != nil {
+			ncp.opts.log.Warn("reject invalid proxy request", slog.String("subject", msg.Subject), slog.Any("err", err))
+			respondError(msg, err)
+			return
+		}
+		if op == creditSuffix {
+			// credit is cheap to apply and has no reply to report a rejection, it is never queued
+			handler(msg)
+			return
+		}
+		if err := ncp.dispatcher(op).submit(key, func() { handler(msg) }); err != nil {
+			ncp.opts.log.Warn("reject proxy request", slog.String("subject", msg.Subject), slog.Any("err", err))
+			respondError(msg, err)
+		}
+	}
+}
+
+// dispatcher returns the dispatcher executing the requests of the operation.
+func (ncp NatsConnProxy) dispatcher(op string) *dispatcher {
+	switch op {
+	case readSuffix:
+		return ncp.reads
+	case writeSuffix:
+		return ncp.writes
+	}
+	return ncp.control
+}
+
+// watchDropped periodically checks the subscriptions for messages dropped by the NATS client
+// because of exceeded pending limits and reports them to the proxy logger.
+func (ncp NatsConnProxy) watchDropped(ctx context.Context, subs []*nats.Subscription) {
+	ticker := time.NewTicker(droppedCheckInterval)
+	defer ticker.Stop()
+
+	reported := make([]int, len(subs))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for i, sub := range subs {
+			dropped, err := sub.Dropped()
+			if err != nil || dropped <= reported[i] {
+				continue
+			}
+			ncp.opts.log.Error("proxy subscription is a slow consumer, messages dropped",
+				slog.String("subject", sub.Subject),
+				slog.Int("dropped", dropped-reported[i]),
+				slog.Int("total", dropped),
+			)
+			reported[i] = dropped
+		}
+	}
+}
+
+// dialHandler opens a session: it dials the upstream address, registers the session under a new session ID
+// and replies with the session ID, the addresses of the upstream connection and the negotiated capabilities.
+// If the client negotiated streaming, the pump pushing the upstream data to the client inbox starts right away.
+//
+// On UDP networks the session is a datagram session: with an address it is a connected UDP socket,
+// without one it is an unconnected socket that sends datagrams to the destinations given by the client.
+// Datagrams are pushed to the client one message per datagram if the client negotiated it.
+// Closing the write side is granted only if the upstream connection has a CloseWrite method.
+func (ncp NatsConnProxy) dialHandler(msg *nats.Msg) {
 	network := msg.Header.Get(networkHeaderKey)
 	addr := msg.Header.Get(addrHeaderKey)
-	readSize := msg.Header.Get(readSizeHeaderKey)
-	rdls := msg.Header.Get(readDeadlineHeaderKey)
-	uuid := msg.Header.Get(connectionUUIDHeaderKey)
+	datagram := isDatagramNetwork(network)
 
-	// check msg.Header nil
-	if msg.Header == nil {
-		msg.Header = nats.Header{}
+	caps := negotiateCaps(msg.Header.Get(capsHeaderKey))
+	// the push capability must match the kind of the session,
+	// unixpacket connections keep their message boundaries only with request/reply reads
+	caps = slices.DeleteFunc(caps, func(c string) bool {
+		return (c == capStream && (datagram || network == "unixpacket")) || (c == capDatagram && !datagram)
+	})
+	streaming := slices.Contains(caps, capStream)
+	pushing := streaming || slices.Contains(caps, capDatagram)
+	inbox := msg.Header.Get(inboxHeaderKey)
+	window, err := strconv.Atoi(msg.Header.Get(windowHeaderKey))
+	if pushing && (inbox == "" || (streaming && (err != nil || window <= 0))) {
+		respondError(msg, fmt.Errorf("invalid stream request: inbox %q, window %q", inbox, msg.Header.Get(windowHeaderKey)))
+		return
 	}
 
-	conn, err := ncp.getNetConn(network, addr, uuid)
+	id, err := _UUIDFromCryptoRand()
 	if err != nil {
-		msg.Header.Set(errHeaderKey, err.Error())
-		_ = msg.Respond(nil)
+		respondError(msg, fmt.Errorf("generate session id: %w", err))
 		return
 	}
-
-	bufSize, err := strconv.Atoi(readSize)
+	options := []GetOption{
+		WithUUID(id),
+		WithLease(ncp.opts.sessionLease),
+		// the session is gone once its connection is closed, no matter who closed it
+		WithOnClose(func() { ncp.sessions.remove(id) }),
+	}
+	s := &proxySession{id: id, network: network}
+	if datagram && addr == "" {
+		s.packet, err = ncp.getPacketConn(network, options...)
+	} else {
+		s.conn, err = ncp.getNetConn(network, addr, options...)
+		if datagram && err == nil {
+			s.packet = connectedPacketConn{Conn: s.conn}
+		}
+	}
 	if err != nil {
-		msg.Header.Set(errHeaderKey, err.Error())
-		_ = msg.Respond(nil)
+		respondError(msg, err)
 		return
 	}
-	buf := make([]byte, bufSize)
-	if readDeadline, err := time.Parse(time.RFC3339Nano, rdls); err == nil && !readDeadline.IsZero() {
-		_ = conn.SetReadDeadline(readDeadline)
+	if _, ok := s.conn.(interface{ CloseWrite() error }); !ok {
+		// the write side of the connection cannot be closed, e.g. a net.Pipe or a connection wrapped by the pool dial function
+		caps = slices.DeleteFunc(caps, func(c string) bool { return c == capCloseWrite })
+	}
+	switch {
+	case streaming:
+		s.pump = newStreamPump(ncp.nc, s.conn, inbox, window, maxFrameSize(ncp.nc))
+	case pushing:
+		s.pump = newPacketPump(ncp.nc, s.packet, inbox, maxFrameSize(ncp.nc))
+	}
+
+	reply := nats.NewMsg("")
+	reply.Header.Set(sessionHeaderKey, id)
+	reply.Header.Set(sessionSubjectHeaderKey, ncp.sessionSubject())
+	if s.conn != nil {
+		reply.Header.Set(localAddrHeaderKey, s.conn.LocalAddr().String())
+		reply.Header.Set(remoteAddrHeaderKey, s.conn.RemoteAddr().String())
+	} else {
+		reply.Header.Set(localAddrHeaderKey, s.packet.LocalAddr().String())
+	}
+	reply.Header.Set(capsHeaderKey, strings.Join(caps, ","))
+	reply.Header.Set(readLimitHeaderKey, strconv.Itoa(ncp.opts.maxReadSize))
+	reply.Header.Set(writeLimitHeaderKey, strconv.Itoa(ncp.opts.maxWriteSize))
+	if ncp.opts.sessionLease > 0 {
+		reply.Header.Set(leaseHeaderKey, strconv.FormatInt(ncp.opts.sessionLease.Milliseconds(), 10))
 	}
-	n, err := conn.Read(buf)
+	ncp.sessions.add(s)
+	if err = msg.RespondMsg(reply); err != nil {
+		ncp.sessions.remove(id)
+		_ = s.close()
+	}
+}
+
+// readHandler processes a read request from a NATS message and retrieves data from the corresponding network connection.
+// Data read before an error is delivered first; the error is reported by the next read.
+//
+// A read request carries the offset of the stream the client has received so far.
+// The data of a reply is kept until a later request acknowledges it, and is sent again if the offset shows
+// that the reply never reached the client, e.g. because the client gave up waiting for it.
+func (ncp NatsConnProxy) readHandler(msg *nats.Msg) {
+	readSize := msg.Header.Get(readSizeHeaderKey)
+	readDeadline := parseTimeoutHeader(msg.Header, readTimeoutHeaderKey)
+
+	s, err := ncp.session(msg)
 	if err != nil {
-		msg.Header.Set(errHeaderKey, err.Error())
-		_ = msg.Respond(nil)
+		respondError(msg, err)
+		return
+	}
+
+	// the read size was validated before the request was dispatched
+	bufSize, _ := strconv.Atoi(readSize)
+	// the reply must fit into a single message, the client reads the rest with its next reads
+	buf := make([]byte, min(bufSize, maxFrameSize(ncp.nc)))
+	if s.packet != nil {
+		ncp.readDatagram(msg, s, buf, readDeadline)
+		return
+	}
+	tracked := msg.Header.Get(readOffsetHeaderKey) != ""
+	if tracked {
+		offset, err := strconv.ParseUint(msg.Header.Get(readOffsetHeaderKey), 10, 64)
+		if err == nil {
+			err = s.acknowledge(offset)
+		}
+		if err != nil {
+			respondError(msg, err)
+			return
+		}
+		if len(s.undelivered) > 0 {
+			n := copy(buf, s.undelivered)
+			_ = msg.Respond(buf[:n])
+			return
+		}
+	}
+	// a zero deadline clears the deadline of an earlier read
+	_ = s.conn.SetReadDeadline(readDeadline)
+	n, err := s.conn.Read(buf)
+	if err != nil && n == 0 {
+		respondError(msg, err)
 		return
 	}
+	if tracked {
+		s.undelivered = slices.Clone(buf[:n])
+	}
 	_ = msg.Respond(buf[:n])
 }
 
-// zeroLenStr represents a byte array containing the value "0".
-var zeroLenStr = []byte("0")
+// readDatagram replies with the next datagram of a datagram session and its source address.
+// A datagram larger than the requested read size is truncated.
+func (ncp NatsConnProxy) readDatagram(msg *nats.Msg, s *proxySession, buf []byte, readDeadline time.Time) {
+	_ = s.packet.SetReadDeadline(readDeadline)
+	n, addr, err := s.packet.ReadFrom(buf)
+	if err != nil {
+		respondError(msg, err)
+		return
+	}
+	reply := nats.NewMsg("")
+	reply.Header.Set(addrHeaderKey, addr.String())
+	reply.Data = buf[:n]
+	_ = msg.RespondMsg(reply)
+}
 
 // writeHandler handles write requests by sending data from the message to the referenced network connection.
+// The reply carries the number of written bytes, together with the error if the write was incomplete.
+//
+// Write frames carry a sequence number. A frame the session has already applied is not written again;
+// the proxy replies with the result of the original write, so clients can safely send a frame again after a lost reply.
+// A frame marked with the write-close header closes the write side of the upstream connection instead of writing to it.
 func (ncp NatsConnProxy) writeHandler(msg *nats.Msg) {
-	network := msg.Header.Get(networkHeaderKey)
-	addr := msg.Header.Get(addrHeaderKey)
-	wdls := msg.Header.Get(writeDeadlineHeaderKey)
-	uuid := msg.Header.Get(connectionUUIDHeaderKey)
+	writeDeadline := parseTimeoutHeader(msg.Header, writeTimeoutHeaderKey)
 
-	// check msg.Header nil
-	if msg.Header == nil {
-		msg.Header = nats.Header{}
+	s, err := ncp.session(msg)
+	if err != nil {
+		respondError(msg, err)
+		return
+	}
+
+	var seq uint64
+	if seqHeader := msg.Header.Get(writeSeqHeaderKey); seqHeader != "" {
+		if seq, err = strconv.ParseUint(seqHeader, 10, 64); err != nil {
+			respondError(msg, invalidRequest("write sequence %q", seqHeader))
+			return
+		}
+		switch {
+		case seq <= s.writeSeq:
+			n, err := s.writeResult(seq, len(msg.Data))
+			respondWrite(msg, s, n, err)
+			return
+		case seq != s.writeSeq+1:
+			respondError(msg, invalidRequest("write sequence %d does not follow %d", seq, s.writeSeq))
+			return
+		}
+	}
+
+	var n int
+	switch {
+	case msg.Header.Get(writeCloseHeaderKey) != "" && s.conn != nil:
+		err = closeWrite(s.conn)
+	case s.conn == nil:
+		n, err = ncp.writeDatagram(msg, s, writeDeadline)
+	default:
+		// a zero deadline clears the deadline of an earlier write
+		_ = s.conn.SetWriteDeadline(writeDeadline)
+		n, err = s.conn.Write(msg.Data)
 	}
+	if seq > 0 {
+		s.recordWrite(seq, n, err)
+	}
+	respondWrite(msg, s, n, err)
+}
 
-	conn, err := ncp.getNetConn(network, addr, uuid)
+// respondWrite replies to a write request with the number of written bytes, the error if the write was incomplete,
+// and the sequence number of the last write frame applied by the session.
+func respondWrite(msg *nats.Msg, s *proxySession, n int, err error) {
+	reply := nats.NewMsg("")
 	if err != nil {
-		msg.Header.Set(errHeaderKey, err.Error())
-		_ = msg.Respond(zeroLenStr)
-		return
+		reply = newErrorMsg(err)
 	}
+	reply.Header.Set(writeAckHeaderKey, strconv.FormatUint(s.writeSeq, 10))
+	reply.Data = []byte(strconv.Itoa(n))
+	_ = msg.RespondMsg(reply)
+}
 
-	if writeDeadline, err := time.Parse(time.RFC3339Nano, wdls); err == nil && !writeDeadline.IsZero() {
-		_ = conn.SetWriteDeadline(writeDeadline)
+// writeDatagram sends the message data as one datagram of an unconnected datagram session.
+// The destination is resolved and checked against the access policy for every datagram, like the address of a dial.
+func (ncp NatsConnProxy) writeDatagram(msg *nats.Msg, s *proxySession, writeDeadline time.Time) (int, error) {
+	addr := msg.Header.Get(addrHeaderKey)
+	if addr == "" {
+		return 0, fmt.Errorf("write: destination address required")
 	}
-	n, err := conn.Write(msg.Data)
+	dst, err := ncp.resolve(s.network, addr)
 	if err != nil {
-		msg.Header.Set(errHeaderKey, err.Error())
-		_ = msg.Respond(zeroLenStr)
-		return
+		return 0, err
 	}
-	_ = msg.Respond([]byte(strconv.Itoa(n)))
+	_ = s.packet.SetWriteDeadline(writeDeadline)
+	return s.packet.WriteTo(msg.Data, dst)
 }
 
-// closeHandler handles NATS messages to close a network connection identified by the network, address, and UUID headers.
+// closeHandler handles NATS messages to close the session identified by the session header.
 func (ncp NatsConnProxy) closeHandler(msg *nats.Msg) {
-	network := msg.Header.Get(networkHeaderKey)
-	addr := msg.Header.Get(addrHeaderKey)
-	uuid := msg.Header.Get(connectionUUIDHeaderKey)
+	s := ncp.sessions.remove(msg.Header.Get(sessionHeaderKey))
+	if s == nil {
+		respondError(msg, errUnknownSession)
+		return
+	}
+	if err := s.close(); err != nil {
+		respondError(msg, err)
+		return
+	}
+	_ = msg.Respond(nil)
+}
 
-	// check msg.Header nil
-	if msg.Header == nil {
-		msg.Header = nats.Header{}
+// creditHandler handles the consumed offset reported by a streaming client, which grants the pump credit beyond it.
+func (ncp NatsConnProxy) creditHandler(msg *nats.Msg) {
+	if s := ncp.sessions.get(msg.Header.Get(sessionHeaderKey)); s != nil {
+		s.acknowledgeStream(msg)
 	}
+}
 
-	conn, err := ncp.getNetConn(network, addr, uuid)
+// keepaliveHandler renews the lease of a session whose client is alive but has no traffic, e.g. a subscriber waiting for messages.
+func (ncp NatsConnProxy) keepaliveHandler(msg *nats.Msg) {
+	s, err := ncp.session(msg)
 	if err != nil {
-		msg.Header.Set(errHeaderKey, err.Error())
-		_ = msg.Respond(nil)
+		respondError(msg, err)
 		return
 	}
+	s.renewLease()
+	s.acknowledgeStream(msg)
+	_ = msg.Respond(nil)
+}
 
-	if err = conn.Close(); err != nil {
-		msg.Header.Set(errHeaderKey, err.Error())
-		_ = msg.Respond(nil)
-		return
+// errUnknownSession is reported for requests referring to a session that is not open on the proxy.
+var errUnknownSession = &ProxyError{Code: ErrCodeClosed, Message: "unknown session"}
+
+// session returns the open session referenced by the session header of the message.
+func (ncp NatsConnProxy) session(msg *nats.Msg) (*proxySession, error) {
+	s := ncp.sessions.get(msg.Header.Get(sessionHeaderKey))
+	if s == nil {
+		return nil, errUnknownSession
 	}
-	_ = msg.Respond(nil)
+	return s, nil
 }
 
-// getNetConn returns a net.Conn by resolving the TCP address and calling the Get method of the connPool with the specified UUID options.
-func (ncp NatsConnProxy) getNetConn(network, addr, uuid string) (net.Conn, error) {
-	tcpAddr, err := net.ResolveTCPAddr(network, addr)
+// getNetConn returns a net.Conn by resolving the TCP, UDP or Unix address with the proxy resolver, checking it against the access policy
+// and calling the Get method of the connPool with the specified options.
+// The resolved address is dialed as is, so the checked address is the one the proxy connects to.
+func (ncp NatsConnProxy) getNetConn(network, addr string, options ...GetOption) (net.Conn, error) {
+	if ncp.unresolved {
+		return ncp.connPool.Get(natsAddr{network: network, addr: addr}, options...)
+	}
+	dst, err := ncp.resolve(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	return ncp.connPool.Get(tcpAddr, WithUUID(uuid))
+	return ncp.connPool.Get(dst, options...)
+}
+
+// getPacketConn returns an unconnected net.PacketConn on the network from the connPool,
+// which must implement the PacketConnManager interface.
+func (ncp NatsConnProxy) getPacketConn(network string, options ...GetOption) (net.PacketConn, error) {
+	pm, ok := ncp.connPool.(PacketConnManager)
+	if !ok {
+		return nil, fmt.Errorf("listen packet: connection pool does not support packet connections: %w", net.UnknownNetworkError(network))
+	}
+	return pm.GetPacket(network, options...)
+}
+
+// resolve resolves the address with the proxy resolver and checks the result against the access policy.
+func (ncp NatsConnProxy) resolve(network, addr string) (net.Addr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ncp.opts.resolveTimeout)
+	defer cancel()
+	dst, err := resolveAddr(ctx, ncp.opts.resolver, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = ncp.opts.policy.checkAddr(addr, dst); err != nil {
+		ncp.opts.log.Warn("deny proxy destination", slog.String("network", network), slog.String("addr", addr), slog.Any("err", err))
+		return nil, err
+	}
+	return dst, nil
 }
@@ -0,0 +1,40 @@
+package net_conn_nats_proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProxyIdleReadsDoNotDelayOtherSessions(t *testing.T) {
+	nc := startTestServer(t)
+	startTestProxy(t, nc, WithMaxWorkers(1))
+
+	// idle sessions long-poll the proxy for data that never comes
+	for i := 0; i < 4; i++ {
+		c, upstream, err := dialTestPipe(t, nc, WithStreaming(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Close(); _ = upstream.Close() })
+		go func() { _, _ = c.Read(make([]byte, 1)) }()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	c, upstream, err := dialTestPipe(t, nc, WithStreaming(false), WithRequestTimeout(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err = upstream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if n, err := c.Read(b); err != nil || string(b[:n]) != "ping" {
+		t.Fatalf("read of an active session: %q, %v", b[:n], err)
+	}
+	if _, err = c.Write([]byte("pong")); err != nil {
+		t.Fatalf("write of an active session: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package net_conn_nats_proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/net/nettest"
+)
+
+const testSubject = "proxy-test"
+
+// startTestServer starts an embedded NATS server and returns a connection to it.
+func startTestServer(t *testing.T) *nats.Conn {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// startTestProxy starts a proxy on testSubject that may dial loopback destinations.
+func startTestProxy(t *testing.T, nc *nats.Conn, options ...ProxyOption) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	options = append([]ProxyOption{WithAccessPolicy(&AccessPolicy{AllowLoopback: true})}, options...)
+	if err := NewNatsConnProxy(nc, testSubject, nil, options...).Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialTestPipe opens a NatsNetConn to a local TCP listener and returns it with the accepted upstream connection.
+func dialTestPipe(t *testing.T, nc *nats.Conn, options ...ConnOption) (*NatsNetConn, net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := NewNatsNetConn(nc, testSubject, l.Addr().(*net.TCPAddr), options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, <-accepted, nil
+}
+
+// streamingModes runs the test in streaming and in request/reply mode.
+func streamingModes(t *testing.T, test func(t *testing.T, streaming bool)) {
+	for _, streaming := range []bool{true, false} {
+		name := "request"
+		if streaming {
+			name = "stream"
+		}
+		t.Run(name, func(t *testing.T) { test(t, streaming) })
+	}
+}
+
+func TestNatsNetConnNettest(t *testing.T) {
+	streamingModes(t, func(t *testing.T, streaming bool) {
+		nc := startTestServer(t)
+		startTestProxy(t, nc)
+		nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+			c, upstream, err := dialTestPipe(t, nc, WithStreaming(streaming))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			return c, upstream, func() { _ = c.Close(); _ = upstream.Close() }, nil
+		})
+	})
+}
+
+func TestNatsNetConnUpstreamHalfClose(t *testing.T) {
+	streamingModes(t, func(t *testing.T, streaming bool) {
+		nc := startTestServer(t)
+		startTestProxy(t, nc)
+		c, upstream, err := dialTestPipe(t, nc, WithStreaming(streaming))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer upstream.Close()
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		_ = upstream.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err = upstream.Write([]byte("bye")); err != nil {
+			t.Fatal(err)
+		}
+		if err = upstream.(*net.TCPConn).CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(c); err != nil || string(b) != "bye" {
+			t.Fatalf("read %q, %v; want %q", b, err, "bye")
+		}
+		// the upstream peer still reads what is written after its EOF
+		if _, err = c.Write([]byte("after eof")); err != nil {
+			t.Fatalf("write after EOF: %v", err)
+		}
+		if err = c.CloseWrite(); err != nil {
+			t.Fatalf("close write: %v", err)
+		}
+		if b, err := io.ReadAll(upstream); err != nil || string(b) != "after eof" {
+			t.Fatalf("upstream read %q, %v; want %q", b, err, "after eof")
+		}
+	})
+}
+
+func TestNatsNetConnReadResend(t *testing.T) {
+	nc := startTestServer(t)
+	startTestProxy(t, nc)
+	c, upstream, err := dialTestPipe(t, nc, WithStreaming(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	readRequest := func(offset uint64) (*nats.Msg, error) {
+		msg := nats.NewMsg(c.sessionSubject + readSuffix)
+		msg.Header.Set(sessionHeaderKey, c.session)
+		msg.Header.Set(readSizeHeaderKey, "64")
+		msg.Header.Set(readOffsetHeaderKey, strconv.FormatUint(offset, 10))
+		return nc.RequestMsg(msg, 5*time.Second)
+	}
+	if _, err = upstream.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	// the reply of this read never reaches the connection, its offset stays 0
+	reply, err := readRequest(0)
+	if err != nil || string(reply.Data) != "abc" {
+		t.Fatalf("first read %v, %v", reply, err)
+	}
+
+	b := make([]byte, 64)
+	n, err := c.Read(b)
+	if err != nil || string(b[:n]) != "abc" {
+		t.Fatalf("resent read %q, %v; want %q", b[:n], err, "abc")
+	}
+	if _, err = upstream.Write([]byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	n, err = c.Read(b)
+	if err != nil || string(b[:n]) != "def" {
+		t.Fatalf("next read %q, %v; want %q", b[:n], err, "def")
+	}
+
+	// an offset beyond the data sent by the proxy is rejected
+	reply, err = readRequest(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pe, ok := remoteError(reply).(*ProxyError); !ok || pe.Code != ErrCodeInvalid {
+		t.Fatalf("read with invalid offset: %v", remoteError(reply))
+	}
+}
+
+func TestNatsNetConnZeroLengthRead(t *testing.T) {
+	streamingModes(t, func(t *testing.T, streaming bool) {
+		nc := startTestServer(t)
+		startTestProxy(t, nc)
+		c, upstream, err := dialTestPipe(t, nc, WithStreaming(streaming))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer upstream.Close()
+		defer c.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := c.Read(nil)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("zero-length read: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("zero-length read blocks")
+		}
+	})
+}
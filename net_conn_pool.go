@@ -1,15 +1,22 @@
 package net_conn_nats_proxy
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // getOptions represents a struct for Get function options.
 type getOptions struct {
-	uuid string
+	uuid    string
+	lease   time.Duration
+	onClose func()
 }
 
 // GetOption represents a function type for setting Get function options.
@@ -32,11 +39,39 @@ func WithUUID(uuid string) GetOption {
 	}
 }
 
+// WithLease sets the idle timeout of a new connection, overriding the idle timeout of the pool.
+// The connection is closed and evicted if it is neither used nor renewed within the lease.
+func WithLease(lease time.Duration) GetOption {
+	return func(o *getOptions) {
+		o.lease = lease
+	}
+}
+
+// WithOnClose sets a function called once when a new connection is closed, whether by its user or by the pool.
+func WithOnClose(fn func()) GetOption {
+	return func(o *getOptions) {
+		o.onClose = fn
+	}
+}
+
 // NetConnManager represents an interface for managing network connections.
 type NetConnManager interface {
 	io.Closer
 	// Get returns a connection from the pool or creates a new one.
-	Get(addr *net.TCPAddr, options ...GetOption) (net.Conn, error)
+	Get(addr net.Addr, options ...GetOption) (net.Conn, error)
+}
+
+// PacketConnManager is implemented by connection managers that also manage unconnected packet connections,
+// which send datagrams to and receive datagrams from any address.
+type PacketConnManager interface {
+	// GetPacket returns a packet connection from the pool or creates a new one listening on the network.
+	GetPacket(network string, options ...GetOption) (net.PacketConn, error)
+}
+
+// LeaseRenewer is implemented by pooled connections whose idle lease can be renewed without I/O,
+// e.g. on a keepalive from a client that is waiting for data.
+type LeaseRenewer interface {
+	RenewLease()
 }
 
 // DialFn represents a function that dials a network address.
@@ -45,64 +80,298 @@ type DialFn func(network, addr string) (net.Conn, error)
 // DefaultDial is the default dial function that dials a network address using net.Dial.
 var DefaultDial DialFn = net.Dial
 
+// ListenPacketFn represents a function that opens a packet connection listening on a local network address.
+type ListenPacketFn func(network, addr string) (net.PacketConn, error)
+
+// DefaultListenPacket is the default function that opens packet connections using net.ListenPacket.
+var DefaultListenPacket ListenPacketFn = net.ListenPacket
+
+// poolOptions represents a struct for NetConnPullManager options.
+type poolOptions struct {
+	idleTimeout  time.Duration
+	reapInterval time.Duration
+	listenPacket ListenPacketFn
+	log          *slog.Logger
+}
+
+// PoolOption represents a function type for setting NetConnPullManager options.
+type PoolOption func(*poolOptions)
+
+func newPoolOptions(options ...PoolOption) *poolOptions {
+	// create a default options instance
+	opts := &poolOptions{reapInterval: DefaultReapInterval, listenPacket: DefaultListenPacket, log: slog.Default()}
+	// apply the options
+	for _, opt := range options {
+		opt(opts)
+	}
+	return opts
+}
+
+// WithIdleTimeout sets the time after which an unused connection is closed and evicted from the pool.
+// Zero, the default, keeps connections until they are closed.
+func WithIdleTimeout(timeout time.Duration) PoolOption {
+	return func(o *poolOptions) {
+		o.idleTimeout = timeout
+	}
+}
+
+// DefaultReapInterval is the default interval at which the pool looks for expired connections.
+const DefaultReapInterval = time.Second
+
+// WithReapInterval sets how often the pool looks for expired connections.
+func WithReapInterval(interval time.Duration) PoolOption {
+	return func(o *poolOptions) {
+		o.reapInterval = interval
+	}
+}
+
+// WithListenPacket sets the function that opens the packet connections returned by GetPacket.
+func WithListenPacket(fn ListenPacketFn) PoolOption {
+	return func(o *poolOptions) {
+		o.listenPacket = fn
+	}
+}
+
+// WithPoolLogger sets the logger used to report evicted connections.
+func WithPoolLogger(log *slog.Logger) PoolOption {
+	return func(o *poolOptions) {
+		o.log = log
+	}
+}
+
+// PoolStats represents the counters of a NetConnPullManager.
+type PoolStats struct {
+	// Open is the number of connections in the pool.
+	Open int
+	// Dialed is the number of connections dialed by the pool.
+	Dialed uint64
+	// Closed is the number of connections closed by their users.
+	Closed uint64
+	// Reaped is the number of connections closed by the pool because their lease expired.
+	Reaped uint64
+	// Broken is the number of connections closed by the pool because of a fatal read or write error.
+	// EOF is not fatal: it only ends the reads, the connection stays open for writes until it is closed.
+	Broken uint64
+	// Shutdown is the number of connections closed by Close of the pool.
+	Shutdown uint64
+}
+
 // NetConnPullManager represents a pool manager for network connections.
 type NetConnPullManager struct {
 	mu   sync.Mutex
-	pool map[string]connEnvelop
+	pool map[string]*poolEntry
 	dial DialFn
+	opts *poolOptions
+
+	reapOnce sync.Once
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	dialed   atomic.Uint64
+	closed   atomic.Uint64
+	reaped   atomic.Uint64
+	broken   atomic.Uint64
+	shutdown atomic.Uint64
 }
 
 // NewNetConnPullManager creates a new instance of NetConnPullManager.
 // It takes a DialFn function as a parameter, which is a function type for dialing a network connection,
 // and returns a pointer to a NetConnPullManager.
 // If fn is nil, it uses the DefaultDial function.
-func NewNetConnPullManager(fn DialFn) *NetConnPullManager {
+// The options configure the eviction of idle connections.
+func NewNetConnPullManager(fn DialFn, options ...PoolOption) *NetConnPullManager {
 	if fn == nil {
 		fn = DefaultDial
 	}
-	return &NetConnPullManager{pool: make(map[string]connEnvelop), dial: fn}
+	return &NetConnPullManager{
+		pool: make(map[string]*poolEntry),
+		dial: fn,
+		opts: newPoolOptions(options...),
+		stop: make(chan struct{}),
+	}
 }
 
+// _ is a variable of type PacketConnManager
+// It is used to assert that the type NetConnPullManager implements the PacketConnManager interface.
+var _ PacketConnManager = &NetConnPullManager{}
+
 // Get retrieves a network connection from the NetConnPullManager pool based on the given address.
-// It takes a *net.TCPAddr as the address parameter and returns a net.Conn and an error.
+// It takes a net.Addr as the address parameter and returns a net.Conn and an error.
 // The function first attempts to find the connection in the pool using the generated key from the address.
-// If the connection is found, it is returned along with a nil error.
+// If the connection is found, its lease is renewed and it is returned along with a nil error.
 // If the connection is not found, the function uses the cp.dial function to create a new connection.
 // If an error occurs while dialing, an error is returned with a formatted message.
 // Otherwise, the newly created connection is added to the pool using the generated key,
 // and the connection along with a nil error is returned.
-func (cp *NetConnPullManager) Get(addr *net.TCPAddr, options ...GetOption) (net.Conn, error) {
+// Closing the returned connection removes it from the pool.
+func (cp *NetConnPullManager) Get(addr net.Addr, options ...GetOption) (net.Conn, error) {
 	opts := newGetOptions(options...)
-
-	cp.mu.Lock()
-	defer cp.mu.Unlock()
-
 	key := cp.generateKey(addr, opts.uuid)
-	cEnv, ok := cp.pool[key]
-	if ok {
-		return cEnv, nil
+
+	if entry := cp.lookup(key); entry != nil && entry.conn != nil {
+		entry.RenewLease()
+		return entry.conn, nil
 	}
 
+	// dial without holding the lock, a slow destination must not block the other connections
 	conn, err := cp.dial(addr.Network(), addr.String())
 	if err != nil {
 		return nil, fmt.Errorf("dial: %w", err)
 	}
-	cp.pool[key] = connEnvelop{Conn: conn, pm: cp, key: key}
-	return conn, nil
+	entry := cp.newEntry(conn, opts)
+	entry.datagram = isDatagramNetwork(addr.Network())
+	entry.conn = newConnEnvelop(conn, entry)
+
+	if existing := cp.add(key, entry); existing != entry {
+		// a concurrent Get for the same key won the race
+		_ = conn.Close()
+		if existing.conn == nil {
+			return nil, fmt.Errorf("connection %s is a packet connection", key)
+		}
+		return existing.conn, nil
+	}
+	return entry.conn, nil
+}
+
+// GetPacket retrieves a packet connection from the NetConnPullManager pool based on the given network and UUID.
+// If the connection is not found, a new one is opened by the listen packet function on an ephemeral port of the network.
+// Closing the returned connection removes it from the pool.
+func (cp *NetConnPullManager) GetPacket(network string, options ...GetOption) (net.PacketConn, error) {
+	opts := newGetOptions(options...)
+	key := fmt.Sprintf("%s-%s", network, opts.uuid)
+
+	if entry := cp.lookup(key); entry != nil && entry.pconn != nil {
+		entry.RenewLease()
+		return entry.pconn, nil
+	}
+
+	pconn, err := cp.opts.listenPacket(network, "")
+	if err != nil {
+		return nil, fmt.Errorf("listen packet: %w", err)
+	}
+	entry := cp.newEntry(pconn, opts)
+	entry.datagram = true
+	pEnv := &packetEnvelop{PacketConn: pconn, poolEntry: entry}
+	entry.pconn = pEnv
+
+	if existing := cp.add(key, entry); existing != entry {
+		// a concurrent GetPacket for the same key won the race
+		_ = pconn.Close()
+		if existing.pconn == nil {
+			return nil, fmt.Errorf("connection %s is not a packet connection", key)
+		}
+		return existing.pconn, nil
+	}
+	return pEnv, nil
+}
+
+// lookup returns the pool entry of the key, or nil if there is no such entry.
+func (cp *NetConnPullManager) lookup(key string) *poolEntry {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.pool[key]
+}
+
+// newEntry creates the pool entry tracking a new connection.
+func (cp *NetConnPullManager) newEntry(closer io.Closer, opts *getOptions) *poolEntry {
+	entry := &poolEntry{pm: cp, closer: closer, lease: cp.opts.idleTimeout, onClose: opts.onClose}
+	if opts.lease > 0 {
+		entry.lease = opts.lease
+	}
+	entry.RenewLease()
+	return entry
+}
+
+// add stores the entry under the key unless another entry was stored first, and returns the stored entry.
+func (cp *NetConnPullManager) add(key string, entry *poolEntry) *poolEntry {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if existing, ok := cp.pool[key]; ok {
+		existing.RenewLease()
+		return existing
+	}
+	entry.key = key
+	cp.dialed.Add(1)
+	cp.pool[key] = entry
+	if entry.lease > 0 {
+		cp.reapOnce.Do(func() { go cp.reap() })
+	}
+	return entry
 }
 
-// Close closes all the connections in the NetConnPullManager pool.
+// Close closes all the connections in the NetConnPullManager pool and stops the eviction of idle connections.
 // It iterates over each connection in the pool and calls the Close() method on them.
-// If an error occurs while closing a connection, it returns an error with a formatted message.
+// Every connection is closed even if closing another one fails; the errors are returned joined.
 // If all connections are successfully closed, it returns a nil error.
 func (cp *NetConnPullManager) Close() error {
-	for _, conn := range cp.pool {
-		err := conn.Close()
-		if err != nil {
-			return fmt.Errorf("close connection: %w", err)
+	cp.stopOnce.Do(func() { close(cp.stop) })
+
+	cp.mu.Lock()
+	entries := make([]*poolEntry, 0, len(cp.pool))
+	for _, entry := range cp.pool {
+		entries = append(entries, entry)
+	}
+	cp.mu.Unlock()
+
+	var errs []error
+	for _, entry := range entries {
+		if err := entry.close(&cp.shutdown); err != nil {
+			errs = append(errs, fmt.Errorf("close connection: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns the current counters of the pool.
+func (cp *NetConnPullManager) Stats() PoolStats {
+	cp.mu.Lock()
+	open := len(cp.pool)
+	cp.mu.Unlock()
+	return PoolStats{
+		Open:     open,
+		Dialed:   cp.dialed.Load(),
+		Closed:   cp.closed.Load(),
+		Reaped:   cp.reaped.Load(),
+		Broken:   cp.broken.Load(),
+		Shutdown: cp.shutdown.Load(),
+	}
+}
+
+// reap periodically closes the connections whose lease expired, until the pool is closed.
+func (cp *NetConnPullManager) reap() {
+	ticker := time.NewTicker(cp.opts.reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cp.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, entry := range cp.expired(time.Now()) {
+			cp.opts.log.Info("evict idle connection",
+				slog.String("key", entry.key),
+				slog.Duration("idle", time.Since(entry.lastActive())),
+				slog.Duration("lease", entry.lease),
+			)
+			_ = entry.close(&cp.reaped)
+		}
+	}
+}
+
+// expired returns the connections whose lease expired at the given time.
+func (cp *NetConnPullManager) expired(now time.Time) []*poolEntry {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	var expired []*poolEntry
+	for _, entry := range cp.pool {
+		if entry.lease > 0 && now.Sub(entry.lastActive()) > entry.lease {
+			expired = append(expired, entry)
 		}
 	}
-	return nil
+	return expired
 }
 
 // delete removes a connection from the NetConnPullManager pool based on the given key.
@@ -113,19 +382,198 @@ func (cp *NetConnPullManager) delete(key string) {
 }
 
 // generateKey generates a key for a connection based on the address and UUID.
-func (cp *NetConnPullManager) generateKey(addr *net.TCPAddr, uuid string) string {
+func (cp *NetConnPullManager) generateKey(addr net.Addr, uuid string) string {
 	return fmt.Sprintf("%s-%s", addr.String(), uuid)
 }
 
-// connEnvelop represents a connection envelop that wraps a net.Conn instance and a NetConnPullManager pointer.
+// isDatagramNetwork reports whether the network transports datagrams rather than a byte stream.
+func isDatagramNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+// _ is a variable of type LeaseRenewer
+// It is used to assert that the type poolEntry implements the LeaseRenewer interface.
+var _ LeaseRenewer = &poolEntry{}
+
+// poolEntry tracks a pooled connection: the last activity for the eviction of idle connections,
+// the error that terminated it, and its removal from the pool when it is closed.
+type poolEntry struct {
+	pm       *NetConnPullManager
+	key      string
+	closer   io.Closer
+	lease    time.Duration
+	onClose  func()
+	datagram bool
+
+	// conn or pconn is the envelope handed out by the pool.
+	conn  net.Conn
+	pconn net.PacketConn
+
+	active    atomic.Int64
+	closed    atomic.Bool
+	closeOnce sync.Once
+	closeErr  error
+
+	// readEOF is set once a read returned io.EOF, the peer closed its write side.
+	readEOF atomic.Bool
+
+	mu         sync.Mutex
+	terminated error
+}
+
+// RenewLease marks the connection as active now.
+func (e *poolEntry) RenewLease() {
+	e.active.Store(time.Now().UnixNano())
+}
+
+// lastActive returns the time of the last activity on the connection.
+func (e *poolEntry) lastActive() time.Time {
+	return time.Unix(0, e.active.Load())
+}
+
+// checkResult renews the lease after an I/O operation and terminates the connection if the operation failed fatally.
+// Errors on datagram connections concern single datagrams and never terminate the connection.
+func (e *poolEntry) checkResult(err error) {
+	e.RenewLease()
+	if !e.datagram && isFatal(err) {
+		e.terminate(err)
+	}
+}
+
+// isFatal reports whether the read or write error leaves the connection unusable.
+// Exceeded deadlines are not fatal, the operation can be retried.
+// EOF is not fatal either: the peer may only have closed its write side and still read what is written to it.
+func isFatal(err error) bool {
+	var ne net.Error
+	return err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) && !(errors.As(err, &ne) && ne.Timeout())
+}
+
+// terminalErr returns the error that terminated the connection, or nil if it is usable.
+func (e *poolEntry) terminalErr() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.terminated
+}
+
+// terminate records the fatal error and evicts the connection from the pool.
+func (e *poolEntry) terminate(err error) {
+	e.mu.Lock()
+	first := e.terminated == nil
+	if first {
+		e.terminated = err
+	}
+	e.mu.Unlock()
+	// a connection closed by its user or the pool fails its pending read, it is not broken
+	if !first || e.closed.Load() {
+		return
+	}
+	e.pm.opts.log.Info("evict broken connection", slog.String("key", e.key), slog.Any("err", err))
+	_ = e.close(&e.pm.broken)
+}
+
+// close closes the connection once, removes it from the pool, counts it and calls the close callback.
+func (e *poolEntry) close(counter *atomic.Uint64) error {
+	e.closeOnce.Do(func() {
+		e.closed.Store(true)
+		counter.Add(1)
+		e.pm.delete(e.key)
+		e.closeErr = e.closer.Close()
+		if e.onClose != nil {
+			e.onClose()
+		}
+	})
+	return e.closeErr
+}
+
+// connEnvelop represents a connection envelop that wraps a net.Conn instance and its pool entry.
+// It renews the lease of the connection on every read and write,
+// and evicts the connection as soon as a read or write fails with a fatal error.
+// EOF only ends the reads: a half-closed connection stays open for writes until it is closed, a write fails or its lease expires.
 type connEnvelop struct {
 	net.Conn
-	pm  *NetConnPullManager
-	key string
+	*poolEntry
+}
+
+// Read reads from the connection and renews its lease.
+// After a fatal error, the connection is evicted and every following read returns the same error.
+// After EOF, every following read returns EOF without reading the connection.
+func (ce *connEnvelop) Read(b []byte) (int, error) {
+	if err := ce.terminalErr(); err != nil {
+		return 0, err
+	}
+	if ce.readEOF.Load() {
+		return 0, io.EOF
+	}
+	n, err := ce.Conn.Read(b)
+	if errors.Is(err, io.EOF) {
+		ce.readEOF.Store(true)
+	}
+	ce.checkResult(err)
+	return n, err
+}
+
+// Write writes to the connection and renews its lease.
+// After a fatal error, the connection is evicted and every following write fails.
+func (ce *connEnvelop) Write(b []byte) (int, error) {
+	if err := ce.terminalErr(); err != nil {
+		return 0, fmt.Errorf("connection terminated by %w: %w", err, net.ErrClosed)
+	}
+	n, err := ce.Conn.Write(b)
+	ce.checkResult(err)
+	return n, err
+}
+
+// Close closes the connection and removes it from the NetConnPullManager pool.
+func (ce *connEnvelop) Close() error {
+	return ce.close(&ce.pm.closed)
+}
+
+// newConnEnvelop wraps the connection into an envelop that has a CloseWrite method only if the connection has one,
+// so users of the envelop can tell whether the write side can be closed.
+func newConnEnvelop(conn net.Conn, entry *poolEntry) net.Conn {
+	ce := &connEnvelop{Conn: conn, poolEntry: entry}
+	if _, ok := conn.(interface{ CloseWrite() error }); ok {
+		return &closeWriteEnvelop{connEnvelop: ce}
+	}
+	return ce
+}
+
+// closeWriteEnvelop is the connEnvelop of a connection that can close its write side, like *net.TCPConn and *net.UnixConn.
+type closeWriteEnvelop struct {
+	*connEnvelop
+}
+
+// CloseWrite closes the write side of the connection.
+func (ce *closeWriteEnvelop) CloseWrite() error {
+	return closeWrite(ce.Conn)
+}
+
+// packetEnvelop represents a packet connection envelop that wraps a net.PacketConn instance and its pool entry.
+// It renews the lease of the connection on every datagram read or written.
+type packetEnvelop struct {
+	net.PacketConn
+	*poolEntry
+}
+
+// ReadFrom reads a datagram from the connection and renews its lease.
+func (pe *packetEnvelop) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := pe.PacketConn.ReadFrom(b)
+	pe.checkResult(err)
+	return n, addr, err
+}
+
+// WriteTo writes a datagram to the address and renews the lease of the connection.
+func (pe *packetEnvelop) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := pe.PacketConn.WriteTo(b, addr)
+	pe.checkResult(err)
+	return n, err
 }
 
 // Close closes the connection and removes it from the NetConnPullManager pool.
-func (ce connEnvelop) Close() error {
-	ce.pm.delete(ce.key)
-	return ce.Conn.Close()
+func (pe *packetEnvelop) Close() error {
+	return pe.close(&pe.pm.closed)
 }
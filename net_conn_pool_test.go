@@ -0,0 +1,35 @@
+package net_conn_nats_proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetConnPullManagerStats(t *testing.T) {
+	dial := func(network, addr string) (net.Conn, error) {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { _ = peer.Close() })
+		return conn, nil
+	}
+	pool := NewNetConnPullManager(dial)
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}
+
+	conn, err := pool.Get(addr, WithUUID("closed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Get(addr, WithUUID("shutdown")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := PoolStats{Dialed: 2, Closed: 1, Shutdown: 1}
+	if got := pool.Stats(); got != want {
+		t.Fatalf("stats %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,283 @@
+package net_conn_nats_proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// _ is a variable of type net.PacketConn
+// It is used to assert that the type NatsPacketConn implements the net.PacketConn interface.
+var _ net.PacketConn = &NatsPacketConn{}
+
+// _ is a variable of type net.Conn
+// It is used to assert that the type NatsPacketConn implements the net.Conn interface.
+var _ net.Conn = &NatsPacketConn{}
+
+// datagram is a datagram pushed by the proxy together with its source address.
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// datagramQueue collects the datagrams pushed by the proxy and serves them to ReadFrom.
+// Datagrams are not subject to credit, so the queue is bounded by the receive window:
+// a datagram that does not fit is dropped, like by the receive buffer of a UDP socket.
+type datagramQueue struct {
+	mu      sync.Mutex
+	queue   []datagram
+	size    int
+	limit   int
+	dropped uint64
+	err     error
+	// signal is closed and replaced whenever a datagram or an error arrives.
+	signal chan struct{}
+}
+
+func newDatagramQueue(limit int) *datagramQueue {
+	return &datagramQueue{limit: limit, signal: make(chan struct{})}
+}
+
+// push appends a datagram to the queue, or drops it if the queue is full.
+func (q *datagramQueue) push(d datagram) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.err != nil {
+		return
+	}
+	if q.size+len(d.data) > q.limit {
+		q.dropped++
+		return
+	}
+	q.queue = append(q.queue, d)
+	q.size += len(d.data)
+	close(q.signal)
+	q.signal = make(chan struct{})
+}
+
+// fail terminates the queue with the error unless it has already been terminated.
+// Queued datagrams are still delivered.
+func (q *datagramQueue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.err != nil {
+		return
+	}
+	q.err = err
+	close(q.signal)
+	q.signal = make(chan struct{})
+}
+
+// read returns the next datagram, waiting for it until the deadline.
+// It returns os.ErrDeadlineExceeded when the deadline passes without a datagram.
+func (q *datagramQueue) read(dl *connDeadline) (datagram, error) {
+	for {
+		q.mu.Lock()
+		if len(q.queue) > 0 {
+			d := q.queue[0]
+			q.queue[0] = datagram{}
+			q.queue = q.queue[1:]
+			q.size -= len(d.data)
+			q.mu.Unlock()
+			return d, nil
+		}
+		if q.err != nil {
+			err := q.err
+			q.mu.Unlock()
+			return datagram{}, err
+		}
+		signal := q.signal
+		q.mu.Unlock()
+
+		if err := dl.wait(signal); err != nil {
+			return datagram{}, err
+		}
+	}
+}
+
+// subscribeDatagrams subscribes to a private inbox that receives the datagrams pushed by the proxy.
+func (c *NatsNetConn) subscribeDatagrams() (*nats.Subscription, error) {
+	network := c.addr.Network()
+	// the handler must not reference the connection, see connResources
+	queue := c.datagrams
+	sub, err := c.nc.Subscribe(c.nc.NewRespInbox(), func(msg *nats.Msg) {
+		if err := remoteError(msg); err != nil {
+			queue.fail(err)
+			return
+		}
+		queue.push(datagram{data: msg.Data, addr: parseAddr(network, msg.Header.Get(addrHeaderKey))})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the queue drops datagrams above the receive window, the subscription must not drop them first
+	_ = sub.SetPendingLimits(-1, -1)
+	return sub, nil
+}
+
+// readDatagram requests the next datagram and its source address from the proxy.
+func (c *NatsNetConn) readDatagram(b []byte) (int, net.Addr, error) {
+	msg, err := c.requestRead(func(timeout time.Time) *nats.Msg {
+		newMsg := nats.NewMsg(c.sessionSubject + readSuffix)
+		newMsg.Header.Set(readSizeHeaderKey, strconv.Itoa(min(len(b), c.readFrameSize())))
+		setTimeoutHeader(newMsg.Header, readTimeoutHeaderKey, timeout)
+		newMsg.Header.Set(sessionHeaderKey, c.session)
+		return newMsg
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	n := copy(b, msg.Data)
+	return n, parseAddr(c.addr.Network(), msg.Header.Get(addrHeaderKey)), nil
+}
+
+// NatsPacketConn is a datagram connection through the proxy, such as a UDP socket.
+// Every message keeps its datagram boundaries: a Write or WriteTo sends exactly one datagram,
+// and a Read or ReadFrom returns exactly one datagram, truncated if b is too small for it.
+//
+// A NatsPacketConn opened by ListenNatsPacket is unconnected: it sends datagrams to the addresses passed to WriteTo
+// and receives datagrams from any source. One opened by DialNatsPacketConn is connected to a single peer,
+// like a net.UDPConn returned by net.Dial.
+//
+// In streaming mode the proxy pushes datagrams as they arrive. Datagrams that arrive while more than
+// the receive window is waiting to be read are dropped.
+type NatsPacketConn struct {
+	conn *NatsNetConn
+}
+
+// ListenNatsPacket opens an unconnected datagram connection on the named network, e.g. "udp", through the proxy.
+// The proxy listens on an ephemeral port and checks the destination of every datagram against its access policy.
+// The context governs the open handshake like in NewNatsNetConnContext.
+func ListenNatsPacket(ctx context.Context, nc *nats.Conn, subject, network string, options ...ConnOption) (*NatsPacketConn, error) {
+	return newNatsPacketConn(ctx, nc, subject, natsAddr{network: network}, options...)
+}
+
+// DialNatsPacketConn opens a datagram connection to the address on the named network, e.g. "udp", through the proxy.
+// Host names in the address are resolved by the proxy.
+// The context governs the open handshake like in NewNatsNetConnContext.
+func DialNatsPacketConn(ctx context.Context, nc *nats.Conn, subject, network, address string, options ...ConnOption) (*NatsPacketConn, error) {
+	if address == "" {
+		return nil, fmt.Errorf("dial %s: missing address", network)
+	}
+	return newNatsPacketConn(ctx, nc, subject, natsAddr{network: network, addr: address}, options...)
+}
+
+// newNatsPacketConn creates the NatsPacketConn instance and opens its session on the proxy.
+func newNatsPacketConn(ctx context.Context, nc *nats.Conn, subject string, addr natsAddr, options ...ConnOption) (*NatsPacketConn, error) {
+	if !isDatagramNetwork(addr.network) {
+		return nil, net.UnknownNetworkError(addr.network)
+	}
+	// generate a UUID for the connection to prevent message collisions
+	uuid, err := _UUIDFromCryptoRand()
+	if err != nil {
+		return nil, fmt.Errorf("generate uuid: %w", err)
+	}
+	opts := newConnOptions(options...)
+	c := &NatsNetConn{nc: nc, subject: subject, addr: addr, uuid: uuid, opts: opts, datagrams: newDatagramQueue(opts.receiveWindow), done: make(chan struct{})}
+	if err = c.dial(ctx); err != nil {
+		return nil, err
+	}
+	return &NatsPacketConn{conn: c}, nil
+}
+
+// ReadFrom reads the next datagram into b and returns its size and source address.
+func (pc *NatsPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c := pc.conn
+	if c.closed.Load() {
+		return 0, nil, c.wrapError("read", net.ErrClosed)
+	}
+	if c.datagrams == nil {
+		c.readMu.Lock()
+		defer c.readMu.Unlock()
+		return c.readDatagram(b)
+	}
+	d, err := c.datagrams.read(&c.readDeadLine)
+	if err != nil {
+		return 0, nil, c.wrapError("read", err)
+	}
+	return copy(b, d.data), d.addr, nil
+}
+
+// Read reads the next datagram into b.
+func (pc *NatsPacketConn) Read(b []byte) (int, error) {
+	n, _, err := pc.ReadFrom(b)
+	return n, err
+}
+
+// WriteTo sends b as one datagram to the address.
+// The address is resolved by the proxy, so it may be a host name of the proxy network.
+// On a connected NatsPacketConn the datagram is sent to the connected peer.
+func (pc *NatsPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if pc.conn.addr.String() != "" {
+		return pc.writeDatagram(b, "")
+	}
+	if addr == nil {
+		return 0, pc.conn.wrapError("write", fmt.Errorf("destination address required"))
+	}
+	return pc.writeDatagram(b, addr.String())
+}
+
+// Write sends b as one datagram to the connected peer.
+func (pc *NatsPacketConn) Write(b []byte) (int, error) {
+	return pc.writeDatagram(b, "")
+}
+
+// writeDatagram sends b as one datagram. Datagrams are never split, so a datagram larger than a frame is rejected.
+func (pc *NatsPacketConn) writeDatagram(b []byte, addr string) (int, error) {
+	c := pc.conn
+	if len(b) > c.writeFrameSize() {
+		return 0, c.wrapError("write", syscall.EMSGSIZE)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed.Load() {
+		return 0, c.wrapError("write", net.ErrClosed)
+	}
+	return c.write(b, addr)
+}
+
+// Close closes the datagram connection and its socket on the proxy.
+func (pc *NatsPacketConn) Close() error {
+	return pc.conn.Close()
+}
+
+// Dropped returns the number of pushed datagrams that were dropped because the receive window was full.
+func (pc *NatsPacketConn) Dropped() uint64 {
+	if pc.conn.datagrams == nil {
+		return 0
+	}
+	pc.conn.datagrams.mu.Lock()
+	defer pc.conn.datagrams.mu.Unlock()
+	return pc.conn.datagrams.dropped
+}
+
+// LocalAddr returns the local address of the socket opened by the proxy.
+func (pc *NatsPacketConn) LocalAddr() net.Addr {
+	return pc.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the connected peer, or nil if the connection is unconnected.
+func (pc *NatsPacketConn) RemoteAddr() net.Addr {
+	return pc.conn.remoteAddr
+}
+
+func (pc *NatsPacketConn) SetDeadline(t time.Time) error {
+	return pc.conn.SetDeadline(t)
+}
+
+func (pc *NatsPacketConn) SetReadDeadline(t time.Time) error {
+	return pc.conn.SetReadDeadline(t)
+}
+
+func (pc *NatsPacketConn) SetWriteDeadline(t time.Time) error {
+	return pc.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,109 @@
+package net_conn_nats_proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// maxDatagramSize is the size of the buffer the proxy reads datagrams into, large enough for any UDP datagram.
+const maxDatagramSize = 64 * 1024
+
+const (
+	// minReadErrorDelay and maxReadErrorDelay bound the pause of the pump after a failed read,
+	// which doubles with every consecutive failure, so a persistent error does not spin the pump.
+	minReadErrorDelay = 5 * time.Millisecond
+	maxReadErrorDelay = time.Second
+)
+
+// packetPump reads the datagrams of a session and publishes each of them to the client inbox as one message,
+// together with its source address. Datagrams are not subject to credit: like on the network itself,
+// datagrams the client cannot keep up with are dropped by the client.
+// Datagrams larger than the NATS max payload allows are dropped by the pump.
+type packetPump struct {
+	nc       *nats.Conn
+	conn     net.PacketConn
+	inbox    string
+	maxFrame int
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+func newPacketPump(nc *nats.Conn, conn net.PacketConn, inbox string, maxFrame int) *packetPump {
+	return &packetPump{nc: nc, conn: conn, inbox: inbox, maxFrame: maxFrame}
+}
+
+// run pumps the datagrams until the connection is closed or the pump is stopped.
+// Errors concerning single datagrams, such as ICMP port unreachable on a connected socket, are skipped
+// after a pause that grows while the reads keep failing.
+// The close of the connection is delivered to the client as the last message.
+func (p *packetPump) run() {
+	// reads of the pump are not bounded by deadlines left over from request/reply reads
+	_ = p.conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, maxDatagramSize)
+	var seq uint64
+	var errDelay time.Duration
+	for !p.isStopped() {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err == nil {
+			errDelay = 0
+		}
+		if err == nil && n > p.maxFrame {
+			continue
+		}
+		if err == nil {
+			seq++
+			if p.publish(seq, buf[:n], addr, nil) != nil {
+				return
+			}
+			continue
+		}
+		if !errors.Is(err, net.ErrClosed) {
+			errDelay = min(max(errDelay*2, minReadErrorDelay), maxReadErrorDelay)
+			time.Sleep(errDelay)
+			continue
+		}
+		if !p.isStopped() {
+			seq++
+			_ = p.publish(seq, nil, nil, err)
+		}
+		return
+	}
+}
+
+// publish sends a datagram, or an error message if err is not nil, to the client inbox.
+func (p *packetPump) publish(seq uint64, data []byte, addr net.Addr, err error) error {
+	msg := nats.NewMsg(p.inbox)
+	if err != nil {
+		msg = newErrorMsg(err)
+		msg.Subject = p.inbox
+	}
+	msg.Header.Set(seqHeaderKey, strconv.FormatUint(seq, 10))
+	if addr != nil {
+		msg.Header.Set(addrHeaderKey, addr.String())
+	}
+	msg.Data = data
+	return p.nc.PublishMsg(msg)
+}
+
+func (p *packetPump) isStopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopped
+}
+
+// acknowledge does nothing, datagrams are not subject to credit.
+func (p *packetPump) acknowledge(uint64) {}
+
+// stop terminates the pump once the current read returns.
+func (p *packetPump) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+}
@@ -0,0 +1,40 @@
+package net_conn_nats_proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingPacketConn is a net.PacketConn whose reads always fail.
+type failingPacketConn struct {
+	net.PacketConn
+	reads atomic.Int64
+}
+
+func (c *failingPacketConn) ReadFrom([]byte) (int, net.Addr, error) {
+	c.reads.Add(1)
+	return 0, nil, errors.New("connection refused")
+}
+
+func (c *failingPacketConn) SetReadDeadline(time.Time) error { return nil }
+
+func TestPacketPumpBacksOffOnReadErrors(t *testing.T) {
+	conn := &failingPacketConn{}
+	p := newPacketPump(nil, conn, "", maxDatagramSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run()
+	}()
+	time.Sleep(300 * time.Millisecond)
+	p.stop()
+	<-done
+
+	// 5ms, 10ms, 20ms, 40ms, 80ms, 160ms
+	if reads := conn.reads.Load(); reads > 10 {
+		t.Fatalf("%d reads in 300ms, the pump does not back off", reads)
+	}
+}
@@ -0,0 +1,205 @@
+package net_conn_nats_proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrAccessDenied is reported when the access policy of the proxy does not allow the destination.
+var ErrAccessDenied = errors.New("access denied")
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Contains reports whether the port is within the range.
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+// AccessRule matches destinations by network prefix, host name pattern, port range and Unix socket path.
+// A rule matches a destination if every non-empty criterion matches it; a rule without criteria matches everything.
+// Paths never match IP destinations, and CIDRs, Hosts and Ports never match Unix socket destinations.
+type AccessRule struct {
+	// CIDRs match the resolved IP address of the destination.
+	CIDRs []netip.Prefix
+	// Hosts match the host name requested by the client, using path.Match patterns such as "*.redis.internal".
+	Hosts []string
+	// Ports match the destination port.
+	Ports []PortRange
+	// Paths match the path of a Unix socket destination, using path.Match patterns such as "/var/run/redis/*.sock".
+	Paths []string
+}
+
+// matches reports whether the rule matches the requested host and the resolved address.
+func (r AccessRule) matches(host string, addr netip.AddrPort) bool {
+	if len(r.Paths) > 0 {
+		return false
+	}
+	if len(r.CIDRs) > 0 && !r.matchesCIDR(addr.Addr()) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !r.matchesHost(host) {
+		return false
+	}
+	if len(r.Ports) > 0 && !r.matchesPort(addr.Port()) {
+		return false
+	}
+	return true
+}
+
+// matchesUnix reports whether the rule matches the path of a Unix socket.
+func (r AccessRule) matchesUnix(socket string) bool {
+	if len(r.CIDRs) > 0 || len(r.Hosts) > 0 || len(r.Ports) > 0 {
+		return false
+	}
+	if len(r.Paths) > 0 && !r.matchesPath(socket) {
+		return false
+	}
+	return true
+}
+
+func (r AccessRule) matchesPath(socket string) bool {
+	for _, pattern := range r.Paths {
+		if ok, _ := path.Match(pattern, socket); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r AccessRule) matchesCIDR(ip netip.Addr) bool {
+	for _, prefix := range r.CIDRs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r AccessRule) matchesHost(host string) bool {
+	for _, pattern := range r.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r AccessRule) matchesPort(port uint16) bool {
+	for _, pr := range r.Ports {
+		if pr.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessPolicy decides which destinations clients may reach through the proxy.
+// It is evaluated after the destination is resolved, against the address the proxy actually dials,
+// so a host name that resolves to a forbidden address is denied as well.
+//
+// A destination is denied if it is a loopback, unspecified or link-local address or a Unix socket that is not explicitly permitted,
+// if it matches any Deny rule, or if Allow rules are set and none of them matches.
+//
+// The zero value denies loopback, link-local and Unix socket destinations and allows everything else.
+type AccessPolicy struct {
+	Allow []AccessRule
+	Deny  []AccessRule
+	// AllowLoopback permits loopback and unspecified destinations such as 127.0.0.1, ::1 and 0.0.0.0.
+	AllowLoopback bool
+	// AllowLinkLocal permits link-local destinations such as 169.254.169.254.
+	AllowLinkLocal bool
+	// AllowUnix permits Unix socket destinations. Like loopback destinations, they reach services local to the proxy host,
+	// so they should be narrowed down with Paths rules.
+	AllowUnix bool
+}
+
+// Check returns an error wrapping ErrAccessDenied if the policy does not allow the destination.
+// The host is the host name requested by the client and the address is its resolved form.
+func (p *AccessPolicy) Check(host string, addr netip.AddrPort) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	ip := addr.Addr()
+
+	switch {
+	case !p.AllowLoopback && (ip.IsLoopback() || ip.IsUnspecified()):
+		return fmt.Errorf("%w: loopback destination %s", ErrAccessDenied, addr)
+	case !p.AllowLinkLocal && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()):
+		return fmt.Errorf("%w: link-local destination %s", ErrAccessDenied, addr)
+	}
+	for _, rule := range p.Deny {
+		if rule.matches(host, addr) {
+			return fmt.Errorf("%w: destination %s (%s) is denied", ErrAccessDenied, host, addr)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, rule := range p.Allow {
+		if rule.matches(host, addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: destination %s (%s) is not allowed", ErrAccessDenied, host, addr)
+}
+
+// CheckPath returns an error wrapping ErrAccessDenied if the policy does not allow the Unix socket destination.
+// The path is cleaned before it is matched, so ".." elements cannot escape an allowed directory.
+func (p *AccessPolicy) CheckPath(socket string) error {
+	socket = cleanSocketPath(socket)
+	if !p.AllowUnix {
+		return fmt.Errorf("%w: unix destination %s", ErrAccessDenied, socket)
+	}
+	for _, rule := range p.Deny {
+		if rule.matchesUnix(socket) {
+			return fmt.Errorf("%w: destination %s is denied", ErrAccessDenied, socket)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, rule := range p.Allow {
+		if rule.matchesUnix(socket) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: destination %s is not allowed", ErrAccessDenied, socket)
+}
+
+// cleanSocketPath returns the shortest equivalent of the Unix socket path.
+// Linux abstract socket names, which start with "@", are not paths and are returned unchanged.
+func cleanSocketPath(socket string) string {
+	if strings.HasPrefix(socket, "@") {
+		return socket
+	}
+	return filepath.Clean(socket)
+}
+
+// checkAddr checks the resolved TCP, UDP or Unix destination of the requested address against the policy.
+func (p *AccessPolicy) checkAddr(address string, addr net.Addr) error {
+	if a, ok := addr.(*net.UnixAddr); ok {
+		return p.CheckPath(a.Name)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	var ap netip.AddrPort
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	default:
+		return fmt.Errorf("%w: unsupported destination %s", ErrAccessDenied, addr)
+	}
+	return p.Check(host, ap)
+}
@@ -0,0 +1,135 @@
+package net_conn_nats_proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+)
+
+func TestAccessPolicyCheck(t *testing.T) {
+	internal := AccessRule{CIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	redis := AccessRule{Hosts: []string{"*.redis.internal"}, Ports: []PortRange{{From: 6379, To: 6380}}}
+
+	tests := []struct {
+		name   string
+		policy AccessPolicy
+		host   string
+		addr   string
+		denied bool
+	}{
+		{name: "public", host: "example.com", addr: "93.184.215.14:443"},
+		{name: "loopback", host: "localhost", addr: "127.0.0.1:80", denied: true},
+		{name: "loopback ipv6", host: "::1", addr: "[::1]:80", denied: true},
+		{name: "ipv4-mapped loopback", host: "::ffff:127.0.0.1", addr: "[::ffff:127.0.0.1]:80", denied: true},
+		{name: "unspecified", host: "0.0.0.0", addr: "0.0.0.0:80", denied: true},
+		{name: "unspecified ipv6", host: "::", addr: "[::]:80", denied: true},
+		{name: "link-local", host: "169.254.169.254", addr: "169.254.169.254:80", denied: true},
+		{name: "link-local ipv6", host: "fe80::1", addr: "[fe80::1]:80", denied: true},
+		{name: "loopback allowed", policy: AccessPolicy{AllowLoopback: true}, host: "localhost", addr: "127.0.0.1:80"},
+		{name: "ipv4-mapped loopback allowed", policy: AccessPolicy{AllowLoopback: true}, host: "::ffff:127.0.0.1", addr: "[::ffff:127.0.0.1]:80"},
+		{name: "link-local allowed", policy: AccessPolicy{AllowLinkLocal: true}, host: "169.254.169.254", addr: "169.254.169.254:80"},
+		{name: "loopback allowed by rule", policy: AccessPolicy{Allow: []AccessRule{{}}}, host: "localhost", addr: "127.0.0.1:80", denied: true},
+		{name: "cidr allowed", policy: AccessPolicy{Allow: []AccessRule{internal}}, host: "db", addr: "10.1.2.3:5432"},
+		{name: "cidr not allowed", policy: AccessPolicy{Allow: []AccessRule{internal}}, host: "db", addr: "192.168.1.1:5432", denied: true},
+		{name: "ipv4-mapped cidr allowed", policy: AccessPolicy{Allow: []AccessRule{internal}}, host: "db", addr: "[::ffff:10.1.2.3]:5432"},
+		{name: "host and port allowed", policy: AccessPolicy{Allow: []AccessRule{redis}}, host: "cache.redis.internal", addr: "10.1.2.3:6380"},
+		{name: "host allowed case-insensitively", policy: AccessPolicy{Allow: []AccessRule{redis}}, host: "Cache.Redis.Internal.", addr: "10.1.2.3:6379"},
+		{name: "port out of range", policy: AccessPolicy{Allow: []AccessRule{redis}}, host: "cache.redis.internal", addr: "10.1.2.3:6381", denied: true},
+		{name: "host not matching", policy: AccessPolicy{Allow: []AccessRule{redis}}, host: "redis.internal", addr: "10.1.2.3:6379", denied: true},
+		{name: "deny wins over allow", policy: AccessPolicy{Allow: []AccessRule{internal}, Deny: []AccessRule{{CIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}}}}, host: "db", addr: "10.0.0.5:5432", denied: true},
+		{name: "deny port range", policy: AccessPolicy{Deny: []AccessRule{{Ports: []PortRange{{From: 1, To: 1023}}}}}, host: "example.com", addr: "93.184.215.14:443", denied: true},
+		{name: "deny port range outside", policy: AccessPolicy{Deny: []AccessRule{{Ports: []PortRange{{From: 1, To: 1023}}}}}, host: "example.com", addr: "93.184.215.14:8443"},
+		{name: "deny host pattern", policy: AccessPolicy{Deny: []AccessRule{{Hosts: []string{"*.example.com"}}}}, host: "www.example.com", addr: "93.184.215.14:443", denied: true},
+		{name: "path rule never matches ip", policy: AccessPolicy{Allow: []AccessRule{{Paths: []string{"/*"}}}}, host: "example.com", addr: "93.184.215.14:443", denied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.host, netip.MustParseAddrPort(tt.addr))
+			if denied := errors.Is(err, ErrAccessDenied); denied != tt.denied {
+				t.Fatalf("Check(%q, %s) = %v, want denied %v", tt.host, tt.addr, err, tt.denied)
+			}
+		})
+	}
+}
+
+func TestAccessPolicyCheckPath(t *testing.T) {
+	redis := AccessRule{Paths: []string{"/var/run/redis/*.sock"}}
+
+	tests := []struct {
+		name   string
+		policy AccessPolicy
+		socket string
+		denied bool
+	}{
+		{name: "unix denied by default", socket: "/var/run/redis/redis.sock", denied: true},
+		{name: "unix allowed", policy: AccessPolicy{AllowUnix: true}, socket: "/var/run/docker.sock"},
+		{name: "path allowed", policy: AccessPolicy{AllowUnix: true, Allow: []AccessRule{redis}}, socket: "/var/run/redis/redis.sock"},
+		{name: "path not allowed", policy: AccessPolicy{AllowUnix: true, Allow: []AccessRule{redis}}, socket: "/var/run/docker.sock", denied: true},
+		{name: "dot-dot escape", policy: AccessPolicy{AllowUnix: true, Allow: []AccessRule{redis}}, socket: "/var/run/redis/../docker.sock", denied: true},
+		{name: "dot-dot within", policy: AccessPolicy{AllowUnix: true, Allow: []AccessRule{redis}}, socket: "/var/run/redis/x/../redis.sock"},
+		{name: "path denied", policy: AccessPolicy{AllowUnix: true, Deny: []AccessRule{redis}}, socket: "/var/run/redis//redis.sock", denied: true},
+		{name: "ip rule never matches path", policy: AccessPolicy{AllowUnix: true, Allow: []AccessRule{{Ports: []PortRange{{From: 0, To: 65535}}}}}, socket: "/var/run/docker.sock", denied: true},
+		{name: "abstract socket", policy: AccessPolicy{AllowUnix: true, Allow: []AccessRule{{Paths: []string{"@redis"}}}}, socket: "@redis"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.CheckPath(tt.socket)
+			if denied := errors.Is(err, ErrAccessDenied); denied != tt.denied {
+				t.Fatalf("CheckPath(%q) = %v, want denied %v", tt.socket, err, tt.denied)
+			}
+		})
+	}
+}
+
+func TestAccessPolicyCheckAddr(t *testing.T) {
+	policy := AccessPolicy{AllowUnix: true, Allow: []AccessRule{
+		{Hosts: []string{"db.internal"}},
+		{Paths: []string{"/var/run/redis/*.sock"}},
+	}}
+
+	tests := []struct {
+		name    string
+		address string
+		addr    net.Addr
+		denied  bool
+	}{
+		{name: "tcp host", address: "db.internal:5432", addr: &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 5432}},
+		{name: "udp host", address: "db.internal:53", addr: &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 53}},
+		{name: "tcp other host", address: "web.internal:80", addr: &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 80}, denied: true},
+		{name: "host resolving to loopback", address: "db.internal:5432", addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5432}, denied: true},
+		{name: "unix", address: "/var/run/redis/redis.sock", addr: &net.UnixAddr{Name: "/var/run/redis/redis.sock", Net: "unix"}},
+		{name: "unix escape", address: "/var/run/redis/../docker.sock", addr: &net.UnixAddr{Name: "/var/run/redis/../docker.sock", Net: "unix"}, denied: true},
+		{name: "unsupported", address: "db.internal:5432", addr: &net.IPAddr{IP: net.IPv4(10, 1, 2, 3)}, denied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.checkAddr(tt.address, tt.addr)
+			if denied := errors.Is(err, ErrAccessDenied); denied != tt.denied {
+				t.Fatalf("checkAddr(%q, %s) = %v, want denied %v", tt.address, tt.addr, err, tt.denied)
+			}
+		})
+	}
+}
+
+func TestProxyDeniesHostResolvingToLoopback(t *testing.T) {
+	nc := startTestServer(t)
+	startTestProxy(t, nc, WithAccessPolicy(&AccessPolicy{}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	c, err := DialNatsNetConn(context.Background(), nc, testSubject, "tcp", net.JoinHostPort("localhost", port))
+	if err == nil {
+		_ = c.Close()
+	}
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("dial localhost: %v, want %v", err, ErrAccessDenied)
+	}
+}
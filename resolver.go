@@ -0,0 +1,186 @@
+package net_conn_nats_proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Resolver resolves the destination requested by a client into the address the proxy dials.
+// The proxy resolves host names in its own network, so clients may use names that exist only there.
+type Resolver interface {
+	Resolve(ctx context.Context, network, address string) (net.Addr, error)
+}
+
+// ResolverFunc represents a function type that can be used as a Resolver.
+type ResolverFunc func(ctx context.Context, network, address string) (net.Addr, error)
+
+// Resolve calls the ResolverFunc.
+func (f ResolverFunc) Resolve(ctx context.Context, network, address string) (net.Addr, error) {
+	return f(ctx, network, address)
+}
+
+const (
+	// DefaultResolveCacheTTL is the default time a resolved host name is kept by the CachingResolver.
+	DefaultResolveCacheTTL = 30 * time.Second
+	// resolveCacheSize is the number of host names after which expired entries are pruned from the cache.
+	resolveCacheSize = 4096
+)
+
+// _ is a variable of type Resolver
+// It is used to assert that the type CachingResolver implements the Resolver interface.
+var _ Resolver = &CachingResolver{}
+
+// CachingResolver resolves TCP and UDP addresses with a net.Resolver and caches the resolved host names for a TTL.
+// Unix socket paths need no resolution and are only cleaned.
+type CachingResolver struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]resolveEntry
+}
+
+// resolveEntry is a cached result of a host name lookup.
+type resolveEntry struct {
+	ips     []netip.Addr
+	expires time.Time
+}
+
+// NewCachingResolver creates a new CachingResolver.
+// If resolver is nil, net.DefaultResolver is used. A non-positive ttl disables caching.
+func NewCachingResolver(resolver *net.Resolver, ttl time.Duration) *CachingResolver {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &CachingResolver{resolver: resolver, ttl: ttl, cache: make(map[string]resolveEntry)}
+}
+
+// Resolve resolves the host and port of the address on the named TCP or UDP network.
+// It returns a *net.TCPAddr or a *net.UDPAddr according to the network, or a *net.UnixAddr on the Unix networks.
+// IP literals are returned without a lookup. For host names the first IPv4 address of the lookup is used on the tcp and udp networks,
+// like net.ResolveTCPAddr does, and the first address if there is none.
+func (r *CachingResolver) Resolve(ctx context.Context, network, address string) (net.Addr, error) {
+	var ipNetwork string
+	switch network {
+	case "unix", "unixpacket", "unixgram":
+		if address == "" {
+			return nil, fmt.Errorf("resolve %s: missing socket path", network)
+		}
+		return &net.UnixAddr{Name: cleanSocketPath(address), Net: network}, nil
+	case "tcp", "udp":
+		ipNetwork = "ip"
+	case "tcp4", "udp4":
+		ipNetwork = "ip4"
+	case "tcp6", "udp6":
+		ipNetwork = "ip6"
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := r.resolver.LookupPort(ctx, network, portStr)
+	if err != nil {
+		return nil, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return addrFromAddrPort(network, netip.AddrPortFrom(ip, uint16(port))), nil
+	}
+
+	ips, err := r.lookup(ctx, ipNetwork, host)
+	if err != nil {
+		return nil, err
+	}
+	return addrFromAddrPort(network, netip.AddrPortFrom(preferIPv4(ips), uint16(port))), nil
+}
+
+// preferIPv4 returns the first IPv4 address, or the first address if there is none,
+// so dual-stack names keep working on hosts without IPv6 connectivity.
+func preferIPv4(ips []netip.Addr) netip.Addr {
+	for _, ip := range ips {
+		if ip.Unmap().Is4() {
+			return ip.Unmap()
+		}
+	}
+	return ips[0].Unmap()
+}
+
+// addrFromAddrPort returns the address as a *net.UDPAddr on UDP networks and as a *net.TCPAddr otherwise.
+func addrFromAddrPort(network string, ap netip.AddrPort) net.Addr {
+	if isDatagramNetwork(network) {
+		return net.UDPAddrFromAddrPort(ap)
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// lookup returns the addresses of the host, from the cache if the entry has not expired.
+func (r *CachingResolver) lookup(ctx context.Context, ipNetwork, host string) ([]netip.Addr, error) {
+	key := ipNetwork + "/" + host
+	now := time.Now()
+
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	ips, err := r.resolver.LookupNetIP(ctx, ipNetwork, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if r.ttl <= 0 {
+		return ips, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= resolveCacheSize {
+		r.prune(now)
+	}
+	r.cache[key] = resolveEntry{ips: ips, expires: now.Add(r.ttl)}
+	return ips, nil
+}
+
+// prune removes the expired entries, or all entries if none has expired.
+func (r *CachingResolver) prune(now time.Time) {
+	for key, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, key)
+		}
+	}
+	if len(r.cache) >= resolveCacheSize {
+		clear(r.cache)
+	}
+}
+
+// resolveAddr resolves the address with the resolver and checks that the result is an address of the network,
+// a *net.UnixAddr on Unix networks, a *net.UDPAddr on UDP networks and a *net.TCPAddr otherwise.
+func resolveAddr(ctx context.Context, resolver Resolver, network, address string) (net.Addr, error) {
+	addr, err := resolver.Resolve(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	switch {
+	case isUnixNetwork(network):
+		_, ok = addr.(*net.UnixAddr)
+	case isDatagramNetwork(network):
+		_, ok = addr.(*net.UDPAddr)
+	default:
+		_, ok = addr.(*net.TCPAddr)
+	}
+	if !ok {
+		return nil, fmt.Errorf("resolve %s: unexpected address type %T for network %s", address, addr, network)
+	}
+	return addr, nil
+}
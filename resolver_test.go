@@ -0,0 +1,42 @@
+package net_conn_nats_proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestPreferIPv4(t *testing.T) {
+	tests := []struct {
+		ips  []string
+		want string
+	}{
+		{[]string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}, "192.0.2.1"},
+		{[]string{"192.0.2.1", "2001:db8::1"}, "192.0.2.1"},
+		{[]string{"2001:db8::1", "::ffff:192.0.2.3"}, "192.0.2.3"},
+		{[]string{"2001:db8::1", "2001:db8::2"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		ips := make([]netip.Addr, 0, len(tt.ips))
+		for _, ip := range tt.ips {
+			ips = append(ips, netip.MustParseAddr(ip))
+		}
+		if got := preferIPv4(ips); got.String() != tt.want {
+			t.Errorf("preferIPv4(%v) = %s, want %s", tt.ips, got, tt.want)
+		}
+	}
+}
+
+func TestCachingResolverUnixNetworks(t *testing.T) {
+	r := NewCachingResolver(nil, 0)
+	for _, network := range []string{"unix", "unixpacket", "unixgram"} {
+		addr, err := r.Resolve(context.Background(), network, "/run/../run/app.sock")
+		if err != nil {
+			t.Fatalf("resolve %s: %v", network, err)
+		}
+		if ua, ok := addr.(*net.UnixAddr); !ok || ua.Name != "/run/app.sock" || ua.Net != network {
+			t.Fatalf("resolve %s: %#v", network, addr)
+		}
+	}
+}
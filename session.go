@@ -0,0 +1,213 @@
+package net_conn_nats_proxy
+
+import (
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// dialSuffix is the subject suffix of the session open handshake.
+	dialSuffix = ".dial"
+	// keepaliveSuffix is the subject suffix of the session lease renewal.
+	keepaliveSuffix = ".keepalive"
+)
+
+const (
+	sessionHeaderKey        = "session"
+	sessionSubjectHeaderKey = "session-subject"
+	localAddrHeaderKey      = "local-addr"
+	remoteAddrHeaderKey     = "remote-addr"
+	capsHeaderKey           = "caps"
+	leaseHeaderKey          = "lease"
+	readOffsetHeaderKey     = "read-offset"
+)
+
+const (
+	// capStream is the capability of pushing upstream data to the client inbox.
+	capStream = "stream"
+	// capDatagram is the capability of pushing upstream datagrams to the client inbox, one message per datagram.
+	capDatagram = "datagram"
+	// capCloseWrite is the capability of closing the write side of the upstream connection, see NatsNetConn.CloseWrite.
+	capCloseWrite = "close-write"
+)
+
+// supportedCaps lists the capabilities implemented by this version of the proxy and the client.
+var supportedCaps = []string{capStream, capDatagram, capCloseWrite}
+
+// negotiateCaps returns the capabilities from the comma-separated list that are supported by this version.
+func negotiateCaps(requested string) []string {
+	var caps []string
+	for _, c := range strings.Split(requested, ",") {
+		if c = strings.TrimSpace(c); slices.Contains(supportedCaps, c) {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// hasCap reports whether the comma-separated capability list contains the capability.
+func hasCap(caps, c string) bool {
+	return slices.Contains(strings.Split(caps, ","), c)
+}
+
+// sessionPump pushes the upstream data of a session to the client inbox.
+type sessionPump interface {
+	run()
+	stop()
+	// acknowledge records the stream offset consumed by the client, which grants credit beyond it.
+	acknowledge(offset uint64)
+}
+
+// proxySession is an upstream connection opened by a dial request.
+// Datagram sessions have a packet connection: for a connected UDP socket it reads from and writes to conn,
+// for an unconnected one conn is nil and every datagram written carries its destination.
+type proxySession struct {
+	id      string
+	network string
+	conn    net.Conn
+	packet  net.PacketConn
+	pump    sessionPump
+
+	// readOffset is the stream offset of undelivered, the data sent by the last read reply
+	// and not yet acknowledged by the client. Reads of a session are serialized, so they need no lock.
+	readOffset  uint64
+	undelivered []byte
+
+	// writeSeq is the sequence number of the last write frame applied to the connection,
+	// lastWrite and lastWriteErr its result. Writes of a session are serialized, so they need no lock.
+	writeSeq     uint64
+	lastWrite    int
+	lastWriteErr error
+}
+
+// recordWrite records the result of the write frame with the sequence number.
+func (s *proxySession) recordWrite(seq uint64, n int, err error) {
+	s.writeSeq, s.lastWrite, s.lastWriteErr = seq, n, err
+}
+
+// writeResult returns the result of a write frame that was already applied.
+// Only the result of the last frame is kept: the client sends a frame only after the previous one was answered,
+// so an earlier frame can only be a stale duplicate, which is acknowledged without a result.
+func (s *proxySession) writeResult(seq uint64, size int) (int, error) {
+	if seq == s.writeSeq {
+		return s.lastWrite, s.lastWriteErr
+	}
+	return size, nil
+}
+
+// acknowledge discards the undelivered data up to the stream offset the client has received.
+func (s *proxySession) acknowledge(offset uint64) error {
+	end := s.readOffset + uint64(len(s.undelivered))
+	if offset < s.readOffset || offset > end {
+		return invalidRequest("read offset %d outside of the unacknowledged range [%d, %d]", offset, s.readOffset, end)
+	}
+	s.undelivered = s.undelivered[offset-s.readOffset:]
+	s.readOffset = offset
+	return nil
+}
+
+// acknowledgeStream passes the consumed offset carried by the credit or keepalive message to the pump, if any.
+func (s *proxySession) acknowledgeStream(msg *nats.Msg) {
+	offset, err := strconv.ParseUint(msg.Header.Get(consumedHeaderKey), 10, 64)
+	if err != nil || s.pump == nil {
+		return
+	}
+	s.pump.acknowledge(offset)
+}
+
+// close closes the upstream connection of the session.
+func (s *proxySession) close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return s.packet.Close()
+}
+
+// renewLease renews the lease of the upstream connection if it is leased.
+func (s *proxySession) renewLease() {
+	var c io.Closer = s.packet
+	if s.conn != nil {
+		c = s.conn
+	}
+	if r, ok := c.(LeaseRenewer); ok {
+		r.RenewLease()
+	}
+}
+
+// connectedPacketConn adapts a connected datagram connection to net.PacketConn.
+// Datagrams are read from and written to the connected peer, whatever address is passed to WriteTo.
+type connectedPacketConn struct {
+	net.Conn
+}
+
+// ReadFrom reads a datagram sent by the connected peer.
+func (c connectedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo writes a datagram to the connected peer.
+func (c connectedPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// sessionRegistry keeps the open sessions of the proxy by session ID.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*proxySession
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*proxySession)}
+}
+
+// add registers the session and starts its stream pump, if any.
+func (r *sessionRegistry) add(s *proxySession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[s.id] = s
+	if s.pump != nil {
+		go s.pump.run()
+	}
+}
+
+// get returns the session or nil if there is no such session.
+func (r *sessionRegistry) get(id string) *proxySession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// remove deletes the session and stops its stream pump.
+func (r *sessionRegistry) remove(id string) *proxySession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil
+	}
+	delete(r.sessions, id)
+	if s.pump != nil {
+		s.pump.stop()
+	}
+	return s
+}
+
+// stopAll stops the stream pumps of all sessions.
+func (r *sessionRegistry) stopAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if s.pump != nil {
+			s.pump.stop()
+		}
+	}
+}
@@ -0,0 +1,351 @@
+// Package socks5 implements a SOCKS5 server (RFC 1928) that satisfies CONNECT requests with a dial function,
+// typically NatsDialer.DialContext, so any SOCKS-capable client can reach the targets of a NatsConnProxy.
+// It supports the username/password authentication of RFC 1929.
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	rnp "github.com/Autodoc-Technology/net-conn-nats-proxy"
+	"github.com/Autodoc-Technology/net-conn-nats-proxy/internal/netutil"
+)
+
+const (
+	socksVersion = 0x05
+	// authVersion is the version of the username/password subnegotiation.
+	authVersion = 0x01
+)
+
+// authentication methods
+const (
+	methodNone         = 0x00
+	methodPassword     = 0x02
+	methodNoAcceptable = 0xff
+)
+
+// commands
+const cmdConnect = 0x01
+
+// address types
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// reply codes
+const (
+	repSucceeded           = 0x00
+	repGeneralFailure      = 0x01
+	repNotAllowed          = 0x02
+	repNetworkUnreachable  = 0x03
+	repHostUnreachable     = 0x04
+	repConnectionRefused   = 0x05
+	repCommandUnsupported  = 0x07
+	repAddrTypeUnsupported = 0x08
+)
+
+const (
+	// DefaultHandshakeTimeout is the default time a client has to authenticate and send its request.
+	DefaultHandshakeTimeout = 10 * time.Second
+	// DefaultDialTimeout is the default time the dial of a CONNECT request may take.
+	DefaultDialTimeout = 30 * time.Second
+)
+
+// DialFunc opens the connection to the target of a CONNECT request, e.g. NatsDialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// AuthFunc reports whether the username and password are valid.
+type AuthFunc func(username, password string) bool
+
+// serverOptions represents a struct for Server options.
+type serverOptions struct {
+	auth             AuthFunc
+	handshakeTimeout time.Duration
+	dialTimeout      time.Duration
+	log              *slog.Logger
+}
+
+// ServerOption represents a function type for setting Server options.
+type ServerOption func(*serverOptions)
+
+func newServerOptions(options ...ServerOption) *serverOptions {
+	// create a default options instance
+	opts := &serverOptions{
+		handshakeTimeout: DefaultHandshakeTimeout,
+		dialTimeout:      DefaultDialTimeout,
+		log:              slog.Default(),
+	}
+	// apply the options
+	for _, opt := range options {
+		opt(opts)
+	}
+	return opts
+}
+
+// WithAuth requires clients to authenticate with a username and password accepted by the function.
+// By default, clients connect without authentication.
+func WithAuth(fn AuthFunc) ServerOption {
+	return func(o *serverOptions) {
+		o.auth = fn
+	}
+}
+
+// WithHandshakeTimeout sets the time a client has to authenticate and send its request.
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.handshakeTimeout = timeout
+	}
+}
+
+// WithDialTimeout sets the time the dial of a CONNECT request may take.
+func WithDialTimeout(timeout time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.dialTimeout = timeout
+	}
+}
+
+// WithLogger sets the logger used to report failed requests.
+func WithLogger(log *slog.Logger) ServerOption {
+	return func(o *serverOptions) {
+		o.log = log
+	}
+}
+
+// Server is a SOCKS5 server accepting CONNECT requests with IPv4, IPv6 and domain name targets.
+// Domain names are passed to the dial function unresolved, so a NatsDialer lets the proxy resolve them in its network.
+// The dial errors are reported to the client with the matching reply code, e.g. connection refused,
+// connection not allowed for destinations denied by the access policy of the proxy, or host unreachable.
+type Server struct {
+	dial DialFunc
+	opts *serverOptions
+}
+
+// NewServer returns a new Server opening the connections with the dial function.
+func NewServer(dial DialFunc, options ...ServerOption) *Server {
+	return &Server{dial: dial, opts: newServerOptions(options...)}
+}
+
+// Serve accepts the client connections on the listener and serves each of them in its own goroutine.
+// Temporary Accept errors, e.g. running out of file descriptors, are retried with a growing delay like in net/http.
+// It returns any other error of Accept, which wraps net.ErrClosed once the listener is closed.
+func (s *Server) Serve(l net.Listener) error {
+	var acceptDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne interface{ Temporary() bool }
+			if errors.As(err, &ne) && ne.Temporary() {
+				acceptDelay = netutil.AcceptBackoff(acceptDelay)
+				s.opts.log.Warn("socks accept", slog.Any("err", err), slog.Duration("retry", acceptDelay))
+				time.Sleep(acceptDelay)
+				continue
+			}
+			return err
+		}
+		acceptDelay = 0
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				s.opts.log.Debug("socks connection", slog.Any("client", conn.RemoteAddr()), slog.Any("err", err))
+			}
+		}()
+	}
+}
+
+// ServeConn serves a single client connection: it negotiates the authentication, handles the request
+// and copies the data between the client and the target until both directions end. The connection is closed on return.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(s.opts.handshakeTimeout))
+	if err := s.negotiate(conn); err != nil {
+		return err
+	}
+	target, err := s.readRequest(conn)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.dialTimeout)
+	remote, err := s.dial(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		s.opts.log.Warn("socks connect", slog.Any("client", conn.RemoteAddr()), slog.String("target", target), slog.Any("err", err))
+		_ = writeReply(conn, replyCode(err), nil)
+		return fmt.Errorf("connect %s: %w", target, err)
+	}
+	if err = writeReply(conn, repSucceeded, remote.LocalAddr()); err != nil {
+		_ = remote.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	netutil.Join(conn, remote)
+	return nil
+}
+
+// negotiate selects the authentication method offered by the client and authenticates it.
+func (s *Server) negotiate(conn net.Conn) error {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fmt.Errorf("read greeting: %w", err)
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("read methods: %w", err)
+	}
+	want := byte(methodNone)
+	if s.opts.auth != nil {
+		want = methodPassword
+	}
+	for _, m := range methods {
+		if m != want {
+			continue
+		}
+		if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+			return err
+		}
+		if want == methodPassword {
+			return s.authenticate(conn)
+		}
+		return nil
+	}
+	_, _ = conn.Write([]byte{socksVersion, methodNoAcceptable})
+	return errors.New("no acceptable authentication method")
+}
+
+// authenticate runs the username/password subnegotiation of RFC 1929.
+func (s *Server) authenticate(conn net.Conn) error {
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return fmt.Errorf("read auth version: %w", err)
+	}
+	if version[0] != authVersion {
+		return fmt.Errorf("unsupported auth version %d", version[0])
+	}
+	username, err := readString(conn)
+	if err != nil {
+		return fmt.Errorf("read username: %w", err)
+	}
+	password, err := readString(conn)
+	if err != nil {
+		return fmt.Errorf("read password: %w", err)
+	}
+	if !s.opts.auth(username, password) {
+		_, _ = conn.Write([]byte{authVersion, 0x01})
+		return fmt.Errorf("authentication failed for user %q", username)
+	}
+	_, err = conn.Write([]byte{authVersion, 0x00})
+	return err
+}
+
+// readRequest reads the request and returns its target as host:port.
+// Requests other than CONNECT and unknown address types are answered with an error reply.
+func (s *Server) readRequest(conn net.Conn) (string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", fmt.Errorf("read request: %w", err)
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case atypIPv4, atypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if header[3] == atypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("read address: %w", err)
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case atypDomain:
+		domain, err := readString(conn)
+		if err != nil {
+			return "", fmt.Errorf("read domain: %w", err)
+		}
+		host = domain
+	default:
+		_ = writeReply(conn, repAddrTypeUnsupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", header[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", fmt.Errorf("read port: %w", err)
+	}
+
+	if header[1] != cmdConnect {
+		_ = writeReply(conn, repCommandUnsupported, nil)
+		return "", fmt.Errorf("unsupported command %d", header[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// readString reads a string prefixed by its length byte.
+func readString(r io.Reader) (string, error) {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, length[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// writeReply writes the reply with the bound address, which is reported as 0.0.0.0:0 unless it is a TCP address.
+func writeReply(w io.Writer, code byte, bound net.Addr) error {
+	ap := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ap = addr.AddrPort()
+	}
+	reply := []byte{socksVersion, code, 0x00}
+	if ip := ap.Addr().Unmap(); ip.Is4() {
+		reply = append(reply, atypIPv4)
+		reply = append(reply, ip.AsSlice()...)
+	} else {
+		reply = append(reply, atypIPv6)
+		reply = append(reply, ip.AsSlice()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, ap.Port())
+	_, err := w.Write(reply)
+	return err
+}
+
+// replyCode maps the error of a dial to the reply code reported to the client.
+// The errors of a NatsNetConn carry the reason reported by the proxy, e.g. a ProxyError matching syscall.ECONNREFUSED.
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var ne net.Error
+	switch {
+	case errors.Is(err, rnp.ErrAccessDenied):
+		return repNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return repConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return repNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return repHostUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		// the target did not answer in time
+		return repHostUnreachable
+	}
+	return repGeneralFailure
+}
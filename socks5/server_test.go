@@ -0,0 +1,223 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"testing"
+
+	rnp "github.com/Autodoc-Technology/net-conn-nats-proxy"
+)
+
+// serveTestConn serves one client connection over net.Pipe and returns the client end
+// and a channel receiving the result of ServeConn.
+func serveTestConn(t *testing.T, s *Server) (net.Conn, <-chan error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	done := make(chan error, 1)
+	go func() { done <- s.ServeConn(server) }()
+	return client, done
+}
+
+// pipeDialer returns a DialFunc that records the requested target and returns one end of a net.Pipe,
+// whose other end is sent to the channel.
+func pipeDialer(targets chan<- string, upstreams chan<- net.Conn) DialFunc {
+	return func(_ context.Context, network, addr string) (net.Conn, error) {
+		targets <- network + " " + addr
+		conn, upstream := net.Pipe()
+		upstreams <- upstream
+		return conn, nil
+	}
+}
+
+func newTestServer(dial DialFunc, options ...ServerOption) *Server {
+	return NewServer(dial, append([]ServerOption{WithLogger(slog.New(slog.DiscardHandler))}, options...)...)
+}
+
+func write(t *testing.T, conn net.Conn, b ...byte) {
+	t.Helper()
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expect(t *testing.T, conn net.Conn, want ...byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %x, want %x", got, want)
+	}
+}
+
+// emptyReply is a reply with the bound address 0.0.0.0:0.
+func emptyReply(code byte) []byte {
+	return []byte{socksVersion, code, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+func TestServeConnConnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		target  string
+	}{
+		{name: "ipv4", request: []byte{atypIPv4, 192, 0, 2, 1, 0x1f, 0x90}, target: "tcp 192.0.2.1:8080"},
+		{name: "ipv6", request: []byte{atypIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}, target: "tcp [2001:db8::1]:80"},
+		{name: "domain", request: append(append([]byte{atypDomain, 11}, "example.com"...), 0x01, 0xbb), target: "tcp example.com:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := make(chan string, 1)
+			upstreams := make(chan net.Conn, 1)
+			client, done := serveTestConn(t, newTestServer(pipeDialer(targets, upstreams)))
+
+			write(t, client, socksVersion, 1, methodNone)
+			expect(t, client, socksVersion, methodNone)
+			write(t, client, append([]byte{socksVersion, cmdConnect, 0x00}, tt.request...)...)
+			if target := <-targets; target != tt.target {
+				t.Fatalf("dialed %q, want %q", target, tt.target)
+			}
+			expect(t, client, emptyReply(repSucceeded)...)
+
+			upstream := <-upstreams
+			go func() { _, _ = client.Write([]byte("ping")) }()
+			expect(t, upstream, []byte("ping")...)
+			go func() { _, _ = upstream.Write([]byte("pong")) }()
+			expect(t, client, []byte("pong")...)
+
+			_ = client.Close()
+			_ = upstream.Close()
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestServeConnPasswordAuth(t *testing.T) {
+	auth := WithAuth(func(username, password string) bool {
+		return username == "user" && password == "secret"
+	})
+	credentials := func(username, password string) []byte {
+		b := append([]byte{authVersion, byte(len(username))}, username...)
+		return append(append(b, byte(len(password))), password...)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		targets := make(chan string, 1)
+		upstreams := make(chan net.Conn, 1)
+		client, done := serveTestConn(t, newTestServer(pipeDialer(targets, upstreams), auth))
+
+		write(t, client, socksVersion, 2, methodNone, methodPassword)
+		expect(t, client, socksVersion, methodPassword)
+		write(t, client, credentials("user", "secret")...)
+		expect(t, client, authVersion, 0x00)
+		write(t, client, socksVersion, cmdConnect, 0x00, atypIPv4, 192, 0, 2, 1, 0, 80)
+		<-targets
+		expect(t, client, emptyReply(repSucceeded)...)
+
+		_ = client.Close()
+		_ = (<-upstreams).Close()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("failure", func(t *testing.T) {
+		client, done := serveTestConn(t, newTestServer(nil, auth))
+
+		write(t, client, socksVersion, 1, methodPassword)
+		expect(t, client, socksVersion, methodPassword)
+		write(t, client, credentials("user", "wrong")...)
+		expect(t, client, authVersion, 0x01)
+		if err := <-done; err == nil {
+			t.Fatal("ServeConn succeeded with a wrong password")
+		}
+	})
+	t.Run("no password offered", func(t *testing.T) {
+		client, done := serveTestConn(t, newTestServer(nil, auth))
+
+		write(t, client, socksVersion, 1, methodNone)
+		expect(t, client, socksVersion, methodNoAcceptable)
+		if err := <-done; err == nil {
+			t.Fatal("ServeConn succeeded without authentication")
+		}
+	})
+}
+
+func TestServeConnUnsupportedRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		code    byte
+	}{
+		{name: "bind", request: []byte{socksVersion, 0x02, 0x00, atypIPv4, 192, 0, 2, 1, 0, 80}, code: repCommandUnsupported},
+		{name: "udp associate", request: []byte{socksVersion, 0x03, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0}, code: repCommandUnsupported},
+		{name: "address type", request: []byte{socksVersion, cmdConnect, 0x00, 0x02}, code: repAddrTypeUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial := func(context.Context, string, string) (net.Conn, error) {
+				t.Error("unsupported request dialed")
+				return nil, errors.New("unexpected dial")
+			}
+			client, done := serveTestConn(t, newTestServer(dial))
+
+			write(t, client, socksVersion, 1, methodNone)
+			expect(t, client, socksVersion, methodNone)
+			write(t, client, tt.request...)
+			expect(t, client, emptyReply(tt.code)...)
+			if err := <-done; err == nil {
+				t.Fatal("ServeConn succeeded with an unsupported request")
+			}
+		})
+	}
+}
+
+func TestServeConnDialError(t *testing.T) {
+	dial := func(context.Context, string, string) (net.Conn, error) {
+		return nil, &rnp.ProxyError{Code: rnp.ErrCodeDenied, Message: "access denied"}
+	}
+	client, done := serveTestConn(t, newTestServer(dial))
+
+	write(t, client, socksVersion, 1, methodNone)
+	expect(t, client, socksVersion, methodNone)
+	write(t, client, socksVersion, cmdConnect, 0x00, atypIPv4, 127, 0, 0, 1, 0, 80)
+	expect(t, client, emptyReply(repNotAllowed)...)
+	if err := <-done; !errors.Is(err, rnp.ErrAccessDenied) {
+		t.Fatalf("ServeConn() = %v, want %v", err, rnp.ErrAccessDenied)
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code byte
+	}{
+		{err: &rnp.ProxyError{Code: rnp.ErrCodeRefused}, code: repConnectionRefused},
+		{err: &rnp.ProxyError{Code: rnp.ErrCodeDenied}, code: repNotAllowed},
+		{err: &rnp.ProxyError{Code: rnp.ErrCodeUnreachable}, code: repHostUnreachable},
+		{err: &rnp.ProxyError{Code: rnp.ErrCodeTimeout}, code: repHostUnreachable},
+		{err: &rnp.ProxyError{Code: rnp.ErrCodeUnknown}, code: repGeneralFailure},
+		{err: fmt.Errorf("dial: %w", &rnp.ProxyError{Code: rnp.ErrCodeRefused}), code: repConnectionRefused},
+		{err: rnp.ErrAccessDenied, code: repNotAllowed},
+		{err: syscall.ENETUNREACH, code: repNetworkUnreachable},
+		{err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, code: repHostUnreachable},
+		{err: context.DeadlineExceeded, code: repHostUnreachable},
+		{err: errors.New("boom"), code: repGeneralFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if code := replyCode(tt.err); code != tt.code {
+				t.Fatalf("replyCode(%v) = %#x, want %#x", tt.err, code, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package net_conn_nats_proxy
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+const creditSuffix = ".credit"
+
+const (
+	inboxHeaderKey  = "inbox"
+	windowHeaderKey = "window"
+	// consumedHeaderKey carries the stream offset consumed by the client, which grants the proxy credit up to the window beyond it.
+	consumedHeaderKey = "consumed"
+	seqHeaderKey      = "seq"
+)
+
+// DefaultReceiveWindow is the default number of bytes the proxy may push to a streaming NatsNetConn
+// before the connection grants more credit.
+const DefaultReceiveWindow = 256 * 1024
+
+// streamBuffer collects the data frames pushed by the proxy and serves them to Read.
+// The proxy never sends more than the granted window, so the buffer is bounded by the window size.
+type streamBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	err     error
+	nextSeq uint64
+	// signal is closed and replaced whenever data or an error arrives.
+	signal chan struct{}
+	// consumed is the stream offset read by the connection, reported the offset last sent to the proxy as credit.
+	consumed uint64
+	reported uint64
+}
+
+func newStreamBuffer() *streamBuffer {
+	return &streamBuffer{nextSeq: 1, signal: make(chan struct{})}
+}
+
+// push appends a data frame to the buffer.
+// A frame that does not follow the previous one means that a frame was lost and the stream is broken.
+func (sb *streamBuffer) push(seq uint64, data []byte, err error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.err != nil {
+		return
+	}
+	if seq != sb.nextSeq {
+		sb.err = &ProxyError{Code: ErrCodeUnknown, Message: "stream frame lost: expected " +
+			strconv.FormatUint(sb.nextSeq, 10) + ", got " + strconv.FormatUint(seq, 10)}
+	} else {
+		sb.nextSeq++
+		sb.buf.Write(data)
+		sb.err = err
+	}
+	close(sb.signal)
+	sb.signal = make(chan struct{})
+}
+
+// fail terminates the stream with the error unless it has already been terminated.
+func (sb *streamBuffer) fail(err error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.err != nil {
+		return
+	}
+	sb.err = err
+	close(sb.signal)
+	sb.signal = make(chan struct{})
+}
+
+// consume advances the consumed offset by n bytes. It returns the new offset and true
+// if it is at least threshold bytes ahead of the reported one, which then becomes the reported offset.
+func (sb *streamBuffer) consume(n, threshold int) (uint64, bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	sb.consumed += uint64(n)
+	if sb.consumed-sb.reported < uint64(threshold) {
+		return 0, false
+	}
+	sb.reported = sb.consumed
+	return sb.consumed, true
+}
+
+// reportedOffset returns the consumed offset last reported to the proxy.
+func (sb *streamBuffer) reportedOffset() uint64 {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.reported
+}
+
+// read copies buffered data into b, waiting for data until the deadline.
+// It returns os.ErrDeadlineExceeded when the deadline passes without data.
+func (sb *streamBuffer) read(b []byte, dl *connDeadline) (int, error) {
+	for {
+		sb.mu.Lock()
+		if sb.buf.Len() > 0 {
+			n, _ := sb.buf.Read(b)
+			sb.mu.Unlock()
+			return n, nil
+		}
+		if sb.err != nil {
+			err := sb.err
+			sb.mu.Unlock()
+			return 0, err
+		}
+		signal := sb.signal
+		sb.mu.Unlock()
+
+		if err := dl.wait(signal); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// subscribeStream subscribes to a private inbox that receives the data frames pushed by the proxy.
+func (c *NatsNetConn) subscribeStream() (*streamBuffer, *nats.Subscription, error) {
+	sb := newStreamBuffer()
+	sub, err := c.nc.Subscribe(c.nc.NewRespInbox(), func(msg *nats.Msg) {
+		seq, _ := strconv.ParseUint(msg.Header.Get(seqHeaderKey), 10, 64)
+		sb.push(seq, msg.Data, remoteError(msg))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// the proxy never exceeds the window, the limits only have to hold it
+	_ = sub.SetPendingLimits(-1, -1)
+	return sb, sub, nil
+}
+
+// readStream serves Read from the stream buffer and returns consumed bytes to the proxy as credit.
+func (c *NatsNetConn) readStream(b []byte) (int, error) {
+	n, err := c.stream.read(b, &c.readDeadLine)
+	if n > 0 {
+		c.grantCredit(n)
+	}
+	return n, c.wrapError("read", err)
+}
+
+// grantCredit accumulates consumed bytes and reports the consumed offset to the proxy once half of the window is consumed,
+// so the proxy can keep the window full without a credit message per frame.
+// The offset is cumulative: a credit message lost on the way is repaired by the next one,
+// or by the next keepalive, which carries the offset as well.
+func (c *NatsNetConn) grantCredit(n int) {
+	offset, ok := c.stream.consume(n, c.opts.receiveWindow/2)
+	if !ok {
+		return
+	}
+	newMsg := nats.NewMsg(c.sessionSubject + creditSuffix)
+	newMsg.Header.Set(sessionHeaderKey, c.session)
+	newMsg.Header.Set(consumedHeaderKey, strconv.FormatUint(offset, 10))
+	_ = c.nc.PublishMsg(newMsg)
+}
+
+// stopStream releases the stream inbox and fails pending and future stream reads with net.ErrClosed.
+func (c *NatsNetConn) stopStream() {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	if c.stream != nil {
+		c.stream.fail(net.ErrClosed)
+	}
+	if c.datagrams != nil {
+		c.datagrams.fail(net.ErrClosed)
+	}
+	if c.streamSub != nil {
+		_ = c.streamSub.Unsubscribe()
+		c.streamSub = nil
+	}
+}
@@ -0,0 +1,136 @@
+package net_conn_nats_proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// streamFrameSize is the maximum number of bytes the proxy puts into a single data frame.
+// Frames are smaller if the NATS max payload does not allow it.
+const streamFrameSize = 64 * 1024
+
+// streamPump reads the upstream connection of a session and publishes the data to the client inbox.
+// It never publishes more than the window beyond the offset consumed by the client, which bounds the client buffer.
+// The client reports the offset cumulatively, so a lost credit message is repaired by any later one.
+type streamPump struct {
+	nc        *nats.Conn
+	conn      net.Conn
+	inbox     string
+	window    int
+	frameSize int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// sent is the stream offset of the data read for the client, including the reservation of the pending read,
+	// consumed the offset the client has consumed.
+	sent     uint64
+	consumed uint64
+	stopped  bool
+}
+
+func newStreamPump(nc *nats.Conn, conn net.Conn, inbox string, window, maxFrame int) *streamPump {
+	p := &streamPump{nc: nc, conn: conn, inbox: inbox, window: window, frameSize: min(streamFrameSize, maxFrame)}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// run pumps the upstream data until the connection fails or the pump is stopped.
+// The terminal error of the connection is delivered to the client as the last frame.
+func (p *streamPump) run() {
+	// reads of the stream are not bounded by deadlines left over from request/reply reads
+	_ = p.conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, p.frameSize)
+	var seq uint64
+	for {
+		size, ok := p.take(len(buf))
+		if !ok {
+			return
+		}
+		n, err := p.conn.Read(buf[:size])
+		// return the part of the reservation the read did not use
+		p.release(size - n)
+		if n > 0 {
+			seq++
+			if p.publish(seq, buf[:n], nil) != nil {
+				return
+			}
+		}
+		if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		seq++
+		_ = p.publish(seq, nil, err)
+		return
+	}
+}
+
+// publish sends a data frame, or an error frame if err is not nil, to the client inbox.
+func (p *streamPump) publish(seq uint64, data []byte, err error) error {
+	msg := nats.NewMsg(p.inbox)
+	if err != nil {
+		msg = newErrorMsg(err)
+		msg.Subject = p.inbox
+	}
+	msg.Header.Set(seqHeaderKey, strconv.FormatUint(seq, 10))
+	msg.Data = data
+	return p.nc.PublishMsg(msg)
+}
+
+// take waits until the client has granted credit and reserves up to max bytes of it.
+// It returns false if the pump was stopped.
+func (p *streamPump) take(max int) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.credit() <= 0 && !p.stopped {
+		p.cond.Wait()
+	}
+	if p.stopped {
+		return 0, false
+	}
+	size := min(max, p.credit())
+	p.sent += uint64(size)
+	return size, true
+}
+
+// credit returns the number of bytes the pump may still send. The caller holds p.mu.
+func (p *streamPump) credit() int {
+	return p.window - int(p.sent-p.consumed)
+}
+
+// release returns the unused part of a reservation.
+func (p *streamPump) release(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sent -= uint64(n)
+}
+
+// acknowledge records the offset consumed by the client. Offsets older than the last one are ignored,
+// offsets beyond the data sent are capped, so the credit never exceeds the window.
+func (p *streamPump) acknowledge(offset uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if offset <= p.consumed {
+		return
+	}
+	p.consumed = min(offset, p.sent)
+	p.cond.Broadcast()
+}
+
+// stop terminates the pump once the current upstream read returns.
+func (p *streamPump) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stopped = true
+	p.cond.Broadcast()
+}
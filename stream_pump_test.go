@@ -0,0 +1,41 @@
+package net_conn_nats_proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamPumpCumulativeCredit(t *testing.T) {
+	p := newStreamPump(nil, nil, "", 10, 10)
+	if size, ok := p.take(10); !ok || size != 10 {
+		t.Fatalf("take: %d, %v; want the whole window", size, ok)
+	}
+
+	taken := make(chan int, 1)
+	go func() {
+		size, _ := p.take(10)
+		taken <- size
+	}()
+	select {
+	case size := <-taken:
+		t.Fatalf("take without credit returned %d", size)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the credit message for offset 4 was lost, the one for offset 8 covers it
+	p.acknowledge(8)
+	select {
+	case size := <-taken:
+		if size != 8 {
+			t.Fatalf("take after acknowledge: %d, want 8", size)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("take still waits after acknowledge")
+	}
+
+	// stale and excessive offsets never grant more than the window
+	p.acknowledge(4)
+	p.acknowledge(100)
+	if size, _ := p.take(100); size != 10 {
+		t.Fatalf("take after excessive offset: %d, want 10", size)
+	}
+}
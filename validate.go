@@ -0,0 +1,97 @@
+package net_conn_nats_proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrInvalidRequest is reported when the proxy rejects a malformed request or one exceeding its limits.
+var ErrInvalidRequest = errors.New("invalid request")
+
+const (
+	// DefaultMaxReadSize is the default largest number of bytes a client may request with a single read.
+	DefaultMaxReadSize = 1024 * 1024
+	// DefaultMaxWriteSize is the default largest payload of a single write request.
+	DefaultMaxWriteSize = 1024 * 1024
+	// DefaultMaxHeaderLength is the default largest length of a request header value.
+	DefaultMaxHeaderLength = 1024
+)
+
+// DefaultNetworks lists the networks clients may dial by default.
+var DefaultNetworks = []string{"tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix", "unixpacket"}
+
+const (
+	// readLimitHeaderKey announces the largest read size the proxy accepts in the dial reply.
+	readLimitHeaderKey = "read-limit"
+	// writeLimitHeaderKey announces the largest write payload the proxy accepts in the dial reply.
+	writeLimitHeaderKey = "write-limit"
+)
+
+// invalidRequest returns an error wrapping ErrInvalidRequest.
+func invalidRequest(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidRequest, fmt.Sprintf(format, args...))
+}
+
+// validateRequest checks the request against the limits of the proxy before it is dispatched,
+// so a violating request is rejected before the proxy allocates buffers or dials anything for it.
+func (ncp NatsConnProxy) validateRequest(op string, msg *nats.Msg) error {
+	for key, values := range msg.Header {
+		for _, value := range values {
+			if len(value) > ncp.opts.maxHeaderLength {
+				return invalidRequest("header %q is longer than %d bytes", key, ncp.opts.maxHeaderLength)
+			}
+		}
+	}
+	for _, key := range []string{readTimeoutHeaderKey, writeTimeoutHeaderKey} {
+		if value := msg.Header.Get(key); value != "" {
+			if timeout, err := time.ParseDuration(value); err != nil || timeout <= 0 {
+				return invalidRequest("header %q: timeout %q", key, value)
+			}
+		}
+	}
+	switch op {
+	case dialSuffix:
+		return ncp.validateDial(msg)
+	case readSuffix:
+		size, err := strconv.Atoi(msg.Header.Get(readSizeHeaderKey))
+		if err != nil || size < 0 {
+			return invalidRequest("read size %q", msg.Header.Get(readSizeHeaderKey))
+		}
+		if size > ncp.opts.maxReadSize {
+			return invalidRequest("read size %d exceeds the limit of %d bytes", size, ncp.opts.maxReadSize)
+		}
+	case writeSuffix:
+		if len(msg.Data) > ncp.opts.maxWriteSize {
+			return invalidRequest("write of %d bytes exceeds the limit of %d bytes", len(msg.Data), ncp.opts.maxWriteSize)
+		}
+	}
+	return nil
+}
+
+// validateDial checks that the network of a dial request is allowed and that the address is well-formed for it.
+// Only UDP networks may omit the address, which opens an unconnected socket.
+func (ncp NatsConnProxy) validateDial(msg *nats.Msg) error {
+	network := msg.Header.Get(networkHeaderKey)
+	addr := msg.Header.Get(addrHeaderKey)
+	if !slices.Contains(ncp.opts.networks, network) {
+		return invalidRequest("network %q is not allowed", network)
+	}
+	switch {
+	case addr == "" && isDatagramNetwork(network) && !isUnixNetwork(network):
+		return nil
+	case addr == "":
+		return invalidRequest("missing address for network %s", network)
+	case isUnixNetwork(network):
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return invalidRequest("address %q: %v", addr, err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package net_conn_nats_proxy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestValidateRequest(t *testing.T) {
+	ncp := NewNatsConnProxy(nil, testSubject, nil,
+		WithMaxReadSize(1024),
+		WithMaxWriteSize(1024),
+		WithMaxHeaderLength(64),
+		WithNetworks("tcp", "udp", "unix"),
+	)
+
+	newMsg := func(headers map[string]string, data []byte) *nats.Msg {
+		msg := nats.NewMsg(testSubject)
+		for key, value := range headers {
+			msg.Header.Set(key, value)
+		}
+		msg.Data = data
+		return msg
+	}
+	tests := []struct {
+		name    string
+		op      string
+		msg     *nats.Msg
+		invalid bool
+	}{
+		{name: "dial", op: dialSuffix, msg: newMsg(map[string]string{networkHeaderKey: "tcp", addrHeaderKey: "example.com:80"}, nil)},
+		{name: "dial unconnected udp", op: dialSuffix, msg: newMsg(map[string]string{networkHeaderKey: "udp"}, nil)},
+		{name: "dial unix", op: dialSuffix, msg: newMsg(map[string]string{networkHeaderKey: "unix", addrHeaderKey: "/var/run/redis.sock"}, nil)},
+		{name: "dial disallowed network", op: dialSuffix, msg: newMsg(map[string]string{networkHeaderKey: "tcp6", addrHeaderKey: "[::1]:80"}, nil), invalid: true},
+		{name: "dial unknown network", op: dialSuffix, msg: newMsg(map[string]string{networkHeaderKey: "ip", addrHeaderKey: "example.com"}, nil), invalid: true},
+		{name: "dial missing address", op: dialSuffix, msg: newMsg(map[string]string{networkHeaderKey: "tcp"}, nil), invalid: true},
+		{name: "dial missing unix address", op: dialSuffix, msg: newMsg(map[string]string{networkHeaderKey: "unix"}, nil), invalid: true},
+		{name: "dial address without port", op: dialSuffix, msg: newMsg(map[string]string{networkHeaderKey: "tcp", addrHeaderKey: "example.com"}, nil), invalid: true},
+		{name: "dial malformed address", op: dialSuffix, msg: newMsg(map[string]string{networkHeaderKey: "tcp", addrHeaderKey: "[::1:80"}, nil), invalid: true},
+		{name: "read", op: readSuffix, msg: newMsg(map[string]string{readSizeHeaderKey: "1024"}, nil)},
+		{name: "read oversized", op: readSuffix, msg: newMsg(map[string]string{readSizeHeaderKey: "1025"}, nil), invalid: true},
+		{name: "read negative size", op: readSuffix, msg: newMsg(map[string]string{readSizeHeaderKey: "-1"}, nil), invalid: true},
+		{name: "read missing size", op: readSuffix, msg: newMsg(nil, nil), invalid: true},
+		{name: "read with timeout", op: readSuffix, msg: newMsg(map[string]string{readSizeHeaderKey: "1", readTimeoutHeaderKey: "1.5s"}, nil)},
+		{name: "read zero timeout", op: readSuffix, msg: newMsg(map[string]string{readSizeHeaderKey: "1", readTimeoutHeaderKey: "0s"}, nil), invalid: true},
+		{name: "read negative timeout", op: readSuffix, msg: newMsg(map[string]string{readSizeHeaderKey: "1", readTimeoutHeaderKey: "-1s"}, nil), invalid: true},
+		{name: "read malformed timeout", op: readSuffix, msg: newMsg(map[string]string{readSizeHeaderKey: "1", readTimeoutHeaderKey: "soon"}, nil), invalid: true},
+		{name: "write", op: writeSuffix, msg: newMsg(nil, make([]byte, 1024))},
+		{name: "write oversized", op: writeSuffix, msg: newMsg(nil, make([]byte, 1025)), invalid: true},
+		{name: "write zero timeout", op: writeSuffix, msg: newMsg(map[string]string{writeTimeoutHeaderKey: "0s"}, nil), invalid: true},
+		{name: "long header", op: closeSuffix, msg: newMsg(map[string]string{connectionUUIDHeaderKey: strings.Repeat("x", 65)}, nil), invalid: true},
+		{name: "long unknown header", op: writeSuffix, msg: newMsg(map[string]string{"x-padding": strings.Repeat("x", 65)}, nil), invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ncp.validateRequest(tt.op, tt.msg)
+			if invalid := err != nil; invalid != tt.invalid {
+				t.Fatalf("validateRequest() = %v, want invalid %v", err, tt.invalid)
+			}
+			if err == nil {
+				return
+			}
+			if !errors.Is(err, ErrInvalidRequest) {
+				t.Fatalf("validateRequest() = %v, want %v", err, ErrInvalidRequest)
+			}
+			if code := errorCodeOf(err); code != ErrCodeInvalid {
+				t.Fatalf("error code %q, want %q", code, ErrCodeInvalid)
+			}
+		})
+	}
+}
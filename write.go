@@ -0,0 +1,178 @@
+package net_conn_nats_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// writeSeqHeaderKey carries the sequence number of a write frame.
+	writeSeqHeaderKey = "write-seq"
+	// writeAckHeaderKey carries the sequence number of the last write frame applied by the proxy.
+	writeAckHeaderKey = "write-ack"
+	// writeCloseHeaderKey marks a write frame that closes the write side of the upstream connection instead of writing data.
+	writeCloseHeaderKey = "write-close"
+)
+
+// DefaultWriteRetries is the default number of times a write frame is sent again after a transient failure.
+const DefaultWriteRetries = 3
+
+// writeRetryBackoff is the pause before a write frame is sent again to a busy proxy.
+const writeRetryBackoff = 50 * time.Millisecond
+
+// writeFrame is a write request identified by its sequence number within the session.
+type writeFrame struct {
+	seq  uint64
+	data []byte
+	// addr is the destination of the datagram on an unconnected datagram session.
+	addr string
+	// closeWrite marks the frame closing the write side of the upstream connection, it carries no data.
+	closeWrite bool
+}
+
+// write sends b as the next write frame of the session.
+// A non-empty addr is the destination of the datagram on an unconnected datagram session.
+// If the outcome of the frame is still unknown when the retries are exhausted, the frame becomes the pending frame,
+// which is sent again before any later data, and b is reported as written together with the error.
+func (c *NatsNetConn) write(b []byte, addr string) (n int, err error) {
+	return c.sendNext(&writeFrame{data: slices.Clone(b), addr: addr})
+}
+
+// sendNext assigns the next sequence number to the frame and sends it, see write.
+func (c *NatsNetConn) sendNext(f *writeFrame) (n int, err error) {
+	if deadlinePassed(c.writeDeadline()) {
+		return 0, c.wrapError("write", os.ErrDeadlineExceeded)
+	}
+	c.writeSeq++
+	f.seq = c.writeSeq
+	n, acked, err := c.sendFrame(f)
+	switch {
+	case acked:
+		return n, err
+	case errors.Is(err, ErrProxyBusy):
+		// the proxy rejected every attempt without handling the frame, the sequence number is still free
+		c.writeSeq--
+		c.pendingWrite = nil
+		return 0, err
+	}
+	c.pendingWrite = f
+	return len(f.data), err
+}
+
+// closeWrite closes the write side of the connection if it supports it, like *net.TCPConn and *net.UnixConn.
+func closeWrite(conn net.Conn) error {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("close write: %w", errors.ErrUnsupported)
+	}
+	return cw.CloseWrite()
+}
+
+// flushPendingWrite sends the pending frame again until the proxy acknowledges it.
+// If the proxy wrote only a part of it, the rest follows in a new frame, as it was already reported as written.
+func (c *NatsNetConn) flushPendingWrite() error {
+	for c.pendingWrite != nil {
+		if deadlinePassed(c.writeDeadline()) {
+			return c.wrapError("write", os.ErrDeadlineExceeded)
+		}
+		f := c.pendingWrite
+		n, acked, err := c.sendFrame(f)
+		if !acked {
+			return err
+		}
+		c.pendingWrite = nil
+		if n >= len(f.data) || f.addr != "" {
+			return err
+		}
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		c.writeSeq++
+		c.pendingWrite = &writeFrame{seq: c.writeSeq, data: f.data[n:], addr: f.addr}
+	}
+	return nil
+}
+
+// sendFrame sends the write frame and sends it again after transient failures.
+// With a write deadline it gives up after writeRetries attempts or when the deadline is too close;
+// without one it keeps sending the frame until the proxy handles it or the connection is closed, like a blocking socket write.
+// The proxy applies each sequence number once, so a frame sent again is never written twice.
+// acked reports whether the proxy handled the frame, so its outcome is known.
+// The error is ErrProxyBusy only if the proxy rejected every attempt, so it never handled the frame;
+// if an attempt went unanswered, the proxy may have applied it and the error is a timeout.
+func (c *NatsNetConn) sendFrame(f *writeFrame) (n int, acked bool, err error) {
+	unanswered := false
+	for attempt := 0; ; attempt++ {
+		n, err = c.requestWrite(f)
+		var pe *ProxyError
+		switch {
+		case err == nil:
+			return n, true, nil
+		case errors.As(err, &pe) && pe.Code == ErrCodeBusy:
+			// the proxy rejected the frame before handling it
+		case errors.Is(err, errWriteUnanswered):
+			unanswered = true
+		default:
+			return n, true, err
+		}
+		if unanswered {
+			err = c.wrapError("write", os.ErrDeadlineExceeded)
+		}
+		// Close flushes the pending frame with the usual number of retries
+		d := c.writeDeadline()
+		if (!d.IsZero() || c.closed.Load()) && (attempt >= c.opts.writeRetries || (!d.IsZero() && time.Until(d) < writeRetryBackoff)) {
+			return 0, false, err
+		}
+		select {
+		case <-c.done:
+			return 0, false, c.wrapError("write", net.ErrClosed)
+		case <-time.After(writeRetryBackoff):
+		}
+	}
+}
+
+// errWriteUnanswered is returned by requestWrite if the proxy did not reply in time
+// or the write deadline changed before it replied, so the outcome of the frame is unknown.
+var errWriteUnanswered = errors.New("write request unanswered")
+
+// requestWrite sends a single write request for the frame and returns the number of bytes the proxy wrote.
+func (c *NatsNetConn) requestWrite(f *writeFrame) (int, error) {
+	deadline, changed := c.writeDeadLine.get()
+	newMsg := nats.NewMsg(c.sessionSubject + writeSuffix)
+	setTimeoutHeader(newMsg.Header, writeTimeoutHeaderKey, deadline)
+	newMsg.Header.Set(sessionHeaderKey, c.session)
+	newMsg.Header.Set(writeSeqHeaderKey, strconv.FormatUint(f.seq, 10))
+	if f.addr != "" {
+		newMsg.Header.Set(addrHeaderKey, f.addr)
+	}
+	if f.closeWrite {
+		newMsg.Header.Set(writeCloseHeaderKey, "1")
+	}
+	newMsg.Data = f.data
+
+	msg, err := c.requestUntil(newMsg, c.replyTimeout(deadline), changed)
+	if err != nil {
+		// a frame interrupted by a new deadline is sent again by sendFrame unless the new deadline has passed
+		if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errDeadlineChanged) {
+			return 0, errWriteUnanswered
+		}
+		return 0, c.requestError("write", err)
+	}
+	replyErr := c.replyError("write", msg)
+	wl, err := strconv.Atoi(string(msg.Data))
+	if err != nil {
+		if replyErr != nil {
+			return 0, replyErr
+		}
+		return 0, fmt.Errorf("parse write length: %w", err)
+	}
+	return wl, replyErr
+}
@@ -0,0 +1,126 @@
+package net_conn_nats_proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestWriteFrameSentAgainIsWrittenOnce(t *testing.T) {
+	nc := startTestServer(t)
+	startTestProxy(t, nc)
+	c, upstream, err := dialTestPipe(t, nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// a frame is sent again when its reply was lost, the proxy answers with the result of the first write
+	c.writeSeq++
+	frame := &writeFrame{seq: c.writeSeq, data: []byte("hello")}
+	for i := 0; i < 2; i++ {
+		if n, err := c.requestWrite(frame); err != nil || n != len(frame.data) {
+			t.Fatalf("write %d: %d, %v", i, n, err)
+		}
+	}
+	if _, err = c.Write([]byte(", world")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(upstream); err != nil || string(b) != "hello, world" {
+		t.Fatalf("upstream read %q, %v; want %q", b, err, "hello, world")
+	}
+}
+
+func TestWriteFrameOutOfSequence(t *testing.T) {
+	nc := startTestServer(t)
+	startTestProxy(t, nc)
+	c, upstream, err := dialTestPipe(t, nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	defer c.Close()
+
+	// a frame must follow the last frame applied by the proxy
+	_, err = c.requestWrite(&writeFrame{seq: c.writeSeq + 2, data: []byte("gap")})
+	var pe *ProxyError
+	if !errors.As(err, &pe) || pe.Code != ErrCodeInvalid {
+		t.Fatalf("write out of sequence: %v", err)
+	}
+}
+
+// startScriptedProxy answers dial and close requests like a proxy and passes the write requests to the handler.
+func startScriptedProxy(t *testing.T, nc *nats.Conn, write nats.MsgHandler) {
+	t.Helper()
+	const sessionSubject = "scripted"
+	handlers := map[string]nats.MsgHandler{
+		testSubject + dialSuffix: func(msg *nats.Msg) {
+			reply := nats.NewMsg("")
+			reply.Header.Set(sessionHeaderKey, "session")
+			reply.Header.Set(sessionSubjectHeaderKey, sessionSubject)
+			_ = msg.RespondMsg(reply)
+		},
+		sessionSubject + writeSuffix: write,
+		sessionSubject + closeSuffix: func(msg *nats.Msg) { _ = msg.Respond(nil) },
+	}
+	for subject, handler := range handlers {
+		sub, err := nc.Subscribe(subject, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = sub.Unsubscribe() })
+	}
+}
+
+func TestWriteWithoutDeadlineRetriesUntilHandled(t *testing.T) {
+	nc := startTestServer(t)
+	var mu sync.Mutex
+	var seqs []string
+	startScriptedProxy(t, nc, func(msg *nats.Msg) {
+		mu.Lock()
+		seqs = append(seqs, msg.Header.Get(writeSeqHeaderKey))
+		attempt := len(seqs)
+		mu.Unlock()
+		switch {
+		case attempt == 1:
+			// the reply is lost, the proxy may have applied the frame
+		case attempt <= 4:
+			respondError(msg, ErrProxyBusy)
+		default:
+			respondWrite(msg, &proxySession{writeSeq: 1}, len(msg.Data), nil)
+		}
+	})
+	c, err := NewNatsNetConn(nc, testSubject, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		WithStreaming(false), WithRequestTimeout(100*time.Millisecond), WithWriteRetries(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// more attempts than the retries of a write with a deadline, and busy replies after an unanswered attempt,
+	// must neither fail the write nor free its sequence number
+	if n, err := c.Write([]byte("hello")); err != nil || n != 5 {
+		t.Fatalf("write: %d, %v", n, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, seq := range seqs {
+		if seq != "1" {
+			t.Fatalf("attempt %d sent sequence %s, want 1", i+1, seq)
+		}
+	}
+	if c.writeSeq != 1 || c.pendingWrite != nil {
+		t.Fatalf("write sequence %d, pending frame %v", c.writeSeq, c.pendingWrite)
+	}
+}